@@ -7,6 +7,7 @@ require (
 	github.com/docker/machine v0.16.2
 	github.com/equinix/equinix-sdk-go v0.41.0
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/time v0.5.0
 	sigs.k8s.io/yaml v1.4.0
 )
 
@@ -9,13 +9,15 @@ import (
 )
 
 type metalSnakeConfig struct {
-	Token     string `json:"token,omitempty"`
-	AuthToken string `json:"auth-token,omitempty"`
-	Facility  string `json:"facility,omitempty"`
-	Metro     string `json:"metro,omitempty"`
-	OS        string `json:"operating-system,omitempty"`
-	Plan      string `json:"plan,omitempty"`
-	ProjectID string `json:"project-id,omitempty"`
+	Token     string   `json:"token,omitempty"`
+	AuthToken string   `json:"auth-token,omitempty"`
+	Facility  string   `json:"facility,omitempty"`
+	Metro     string   `json:"metro,omitempty"`
+	OS        string   `json:"operating-system,omitempty"`
+	Plan      string   `json:"plan,omitempty"`
+	ProjectID string   `json:"project-id,omitempty"`
+	SSHKeyID  string   `json:"ssh-key-id,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
 }
 
 func getConfigFile() string {
@@ -3,14 +3,24 @@
 package metal
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/carmo-evan/strtotime"
@@ -27,8 +37,73 @@ import (
 const (
 	dockerConfigDir = "/etc/docker"
 	consumerToken   = "24e70949af5ecd17fe8e867b335fc88e7de8bd4ad617c0403d8769a376ddea72"
-	defaultOS       = "ubuntu_20_04"
+	defaultOS       = "ubuntu_22_04"
 	defaultMetro    = "dc"
+
+	// hwReservationNextAvailable selects any free hardware reservation in
+	// the project instead of a specific reservation UUID.
+	hwReservationNextAvailable = "next-available"
+
+	// anyLocation is the facility/metro wildcard that skips strict
+	// validation and lets the scheduler (or the driver) pick a location.
+	anyLocation = "any"
+
+	// defaultPowerTimeout bounds how long Start and Stop wait for the
+	// device to reach the requested power state.
+	defaultPowerTimeout = 5 * time.Minute
+
+	// defaultMaxRps is the default API requests-per-second ceiling shared
+	// by all clients built for the same auth token.
+	defaultMaxRps = 10
+
+	// maxSpotPriceCeiling rejects spot bids that are obviously typos; no
+	// plan costs anywhere near this much per hour.
+	maxSpotPriceCeiling = 1000.0
+
+	// defaultApiTimeout bounds each individual API request so a hung
+	// connection cannot stall a poll loop indefinitely.
+	defaultApiTimeout = 30 * time.Second
+
+	// maxUserdataSize is the documented Equinix Metal limit on device
+	// userdata; larger payloads are rejected by the API deep inside create.
+	maxUserdataSize = 64 * 1024
+
+	// capacityRetryInterval paces repeated create attempts while waiting for
+	// plan capacity to free up under --metal-capacity-retry.
+	capacityRetryInterval = 30 * time.Second
+
+	// removeRetryTimeout and removeRetryInterval bound the delete retries in
+	// Remove while a device is still mid-provision and the API answers 422.
+	removeRetryTimeout  = 5 * time.Minute
+	removeRetryInterval = 10 * time.Second
+
+	// defaultStateCacheTTL keeps rapid repeated GetState calls (docker-machine
+	// status, ls) from each hitting the API.
+	defaultStateCacheTTL = 2 * time.Second
+
+	// network types the device's ports can be converted to after
+	// provisioning; layer3 is the platform default and needs no conversion
+	networkTypeLayer3           = "layer3"
+	networkTypeHybrid           = "hybrid"
+	networkTypeLayer2Individual = "layer2-individual"
+	networkTypeLayer2Bonded     = "layer2-bonded"
+
+	// Equinix Metal derives the bond interface's mode from its bonding
+	// state: bonded ports run LACP, disbonded ports fall back to
+	// balance-tlb.
+	bondMode8023ad     = "802.3ad"
+	bondModeBalanceTlb = "balance-tlb"
+
+	// spotTerminationStopped and spotTerminationNone are the
+	// --metal-spot-termination-action choices for how GetState reports a
+	// spot device Equinix Metal has reclaimed.
+	spotTerminationStopped = "stopped"
+	spotTerminationNone    = "none"
+
+	// sshKeyLabelPrefix is the label convention for uploaded SSH keys; it
+	// doubles as the marker ListManagedDevices uses to recognize devices
+	// this driver provisioned.
+	sshKeyLabelPrefix = "docker machine: "
 )
 
 type envSuffix string
@@ -43,21 +118,81 @@ var (
 	envAuthToken       envSuffix = "_AUTH_TOKEN"
 	envApiKey          envSuffix = "_API_KEY"
 	envProjectID       envSuffix = "_PROJECT_ID"
+	envProjectName     envSuffix = "_PROJECT_NAME"
+	envOrganizationID  envSuffix = "_ORGANIZATION_ID"
 	envOS              envSuffix = "_OS"
 	envFacilityCode    envSuffix = "_FACILITY_CODE"
 	envMetroCode       envSuffix = "_METRO_CODE"
 	envPlan            envSuffix = "_PLAN"
 	envHwId            envSuffix = "_HW_ID"
 	envBillingCycle    envSuffix = "_BILLING_CYCLE"
-	envUserdata        envSuffix = "_USERDATA"
+	envUserdata        envSuffix = "_USERDATA_FILE"
+	envUserdataInline  envSuffix = "_USERDATA"
+	envTags            envSuffix = "_TAGS"
 	envSpotInstance    envSuffix = "_SPOT_INSTANCE"
 	envSpotPriceMax    envSuffix = "_SPOT_PRICE_MAX"
+	envSpotPriceMarket envSuffix = "_SPOT_PRICE_MARKET"
 	envTerminationTime envSuffix = "_TERMINATION_TIME"
 	envUAPrefix        envSuffix = "_UA_PREFIX"
+	envApiUrl          envSuffix = "_API_URL"
+	envHttpsProxy      envSuffix = "_HTTPS_PROXY"
+	envApiRetries      envSuffix = "_API_RETRIES"
+	envDeviceJson      envSuffix = "_OUTPUT_DEVICE_JSON"
+	envLockDevice      envSuffix = "_LOCK_DEVICE"
+	envAllowAnyOS      envSuffix = "_ALLOW_ANY_OS"
+	envAlwaysPxe       envSuffix = "_ALWAYS_PXE"
+	envIpxeScriptUrl   envSuffix = "_IPXE_SCRIPT_URL"
+	envSSHUser         envSuffix = "_SSH_USER"
+	envSSHKeyPath      envSuffix = "_SSH_KEY_PATH"
+	envSSHPort         envSuffix = "_SSH_PORT"
+	envPowerTimeout    envSuffix = "_POWER_TIMEOUT"
+	envSSHWaitTimeout  envSuffix = "_WAIT_FOR_SSH_TIMEOUT"
+	envHostname        envSuffix = "_HOSTNAME"
+	envDescription     envSuffix = "_DESCRIPTION"
+	envNoPublicIp      envSuffix = "_NO_PUBLIC_IP"
+	envIpReservations  envSuffix = "_IP_RESERVATION_IDS"
+	envGlobalIp        envSuffix = "_RESERVED_IP_GLOBAL"
+	envWaitOnRestart   envSuffix = "_WAIT_ON_RESTART"
+	envDebug           envSuffix = "_DEBUG"
+	envProjectSSHKeys  envSuffix = "_PROJECT_SSH_KEYS"
+	envAdoptExisting   envSuffix = "_ADOPT_EXISTING"
+	envCapacityRetry   envSuffix = "_CAPACITY_RETRY"
+	envSpotFallback    envSuffix = "_SPOT_FALLBACK_ON_DEMAND"
+	envSSHKeyLabel     envSuffix = "_SSH_KEY_LABEL"
+	envPostCreateCmd   envSuffix = "_POST_CREATE_COMMAND"
+	envFeatures        envSuffix = "_FEATURES"
+	envDeleteOnError   envSuffix = "_DELETE_ON_ERROR"
+	envBondMode        envSuffix = "_BOND_MODE"
+	envUserdataGzip    envSuffix = "_USERDATA_COMPRESS"
+	envUserdataMerge   envSuffix = "_USERDATA_MERGE"
+	envProvisionStall  envSuffix = "_MAX_PROVISION_PERCENTAGE_STALL_TIMEOUT"
+	envReuseSSHKey     envSuffix = "_REUSE_SSH_KEY"
+	envTailEvents      envSuffix = "_TAIL_EVENTS"
+	envKeepReservation envSuffix = "_KEEP_RESERVATION"
+	envSpotTermAction  envSuffix = "_SPOT_TERMINATION_ACTION"
+	envRegion          envSuffix = "_REGION"
+	envSkipSSHWait     envSuffix = "_SKIP_SSH_WAIT"
+	envDryRun          envSuffix = "_DRY_RUN"
+	envMaxRps          envSuffix = "_MAX_RPS"
+	envFacilityToMetro envSuffix = "_FACILITY_TO_METRO"
+	envCustomdata      envSuffix = "_CUSTOMDATA"
+	envApiTimeout      envSuffix = "_API_TIMEOUT"
+	envAuthTokenFile   envSuffix = "_AUTH_TOKEN_FILE"
+	envEnableBgp       envSuffix = "_ENABLE_BGP"
+	envBgpMd5          envSuffix = "_BGP_MD5"
+	envNetworkType     envSuffix = "_NETWORK_TYPE"
+	envVlan            envSuffix = "_VLAN"
+	envStateCacheTtl   envSuffix = "_STATE_CACHE_TTL"
+	envUserdataTmpl    envSuffix = "_USERDATA_TEMPLATE"
+	envUASuffix        envSuffix = "_UA_SUFFIX"
+	envConsumerToken   envSuffix = "_CONSUMER_TOKEN"
+	envNoConsumerToken envSuffix = "_NO_CONSUMER_TOKEN"
 
 	argAuthToken       argSuffix = "-auth-token"
 	argApiKey          argSuffix = "-api-key"
 	argProjectID       argSuffix = "-project-id"
+	argProjectName     argSuffix = "-project-name"
+	argOrganizationID  argSuffix = "-organization-id"
 	argOS              argSuffix = "-os"
 	argFacilityCode    argSuffix = "-facility-code"
 	argMetroCode       argSuffix = "-metro-code"
@@ -65,13 +200,102 @@ var (
 	argHwId            argSuffix = "-hw-reservation-id"
 	argBillingCycle    argSuffix = "-billing-cycle"
 	argUserdata        argSuffix = "-userdata"
+	argUserdataInline  argSuffix = "-userdata-inline"
+	argTags            argSuffix = "-tags"
 	argSpotInstance    argSuffix = "-spot-instance"
 	argSpotPriceMax    argSuffix = "-spot-price-max"
+	argSpotPriceMarket argSuffix = "-spot-price-market"
 	argTerminationTime argSuffix = "-termination-time"
 	argUAPrefix        argSuffix = "-ua-prefix"
+	argApiUrl          argSuffix = "-api-url"
+	argHttpsProxy      argSuffix = "-https-proxy"
+	argApiRetries      argSuffix = "-api-retries"
+	argDeviceJson      argSuffix = "-output-device-json"
+	argLockDevice      argSuffix = "-lock-device"
+	argAllowAnyOS      argSuffix = "-allow-any-os"
+	argAlwaysPxe       argSuffix = "-always-pxe"
+	argIpxeScriptUrl   argSuffix = "-ipxe-script-url"
+	argSSHUser         argSuffix = "-ssh-user"
+	argSSHKeyPath      argSuffix = "-ssh-key-path"
+	argSSHPort         argSuffix = "-ssh-port"
+	argPowerTimeout    argSuffix = "-power-timeout"
+	argSSHWaitTimeout  argSuffix = "-wait-for-ssh-timeout"
+	argHostname        argSuffix = "-hostname"
+	argDescription     argSuffix = "-description"
+	argNoPublicIp      argSuffix = "-no-public-ip"
+	argIpReservations  argSuffix = "-ip-reservation-ids"
+	argGlobalIp        argSuffix = "-reserved-ip-global"
+	argWaitOnRestart   argSuffix = "-wait-on-restart"
+	argDebug           argSuffix = "-debug"
+	argProjectSSHKeys  argSuffix = "-project-ssh-keys"
+	argAdoptExisting   argSuffix = "-adopt-existing"
+	argCapacityRetry   argSuffix = "-capacity-retry"
+	argSpotFallback    argSuffix = "-spot-fallback-on-demand"
+	argSSHKeyLabel     argSuffix = "-ssh-key-label"
+	argPostCreateCmd   argSuffix = "-post-create-command"
+	argFeatures        argSuffix = "-features"
+	argDeleteOnError   argSuffix = "-delete-on-error"
+	argBondMode        argSuffix = "-bond-mode"
+	argUserdataGzip    argSuffix = "-userdata-compress"
+	argUserdataMerge   argSuffix = "-userdata-merge"
+	argProvisionStall  argSuffix = "-max-provision-percentage-stall-timeout"
+	argReuseSSHKey     argSuffix = "-reuse-ssh-key"
+	argTailEvents      argSuffix = "-tail-events"
+	argKeepReservation argSuffix = "-keep-reservation"
+	argSpotTermAction  argSuffix = "-spot-termination-action"
+	argRegion          argSuffix = "-region"
+	argSkipSSHWait     argSuffix = "-skip-ssh-wait"
+	argDryRun          argSuffix = "-dry-run"
+	argMaxRps          argSuffix = "-max-rps"
+	argFacilityToMetro argSuffix = "-facility-to-metro"
+	argCustomdata      argSuffix = "-customdata"
+	argApiTimeout      argSuffix = "-api-timeout"
+	argAuthTokenFile   argSuffix = "-auth-token-file"
+	argEnableBgp       argSuffix = "-enable-bgp"
+	argBgpMd5          argSuffix = "-bgp-md5"
+	argNetworkType     argSuffix = "-network-type"
+	argVlan            argSuffix = "-vlan"
+	argStateCacheTtl   argSuffix = "-state-cache-ttl"
+	argUserdataTmpl    argSuffix = "-userdata-template"
+	argUASuffix        argSuffix = "-ua-suffix"
+	argConsumerToken   argSuffix = "-consumer-token"
+	argNoConsumerToken argSuffix = "-no-consumer-token"
 
 	// build time check that the Driver type implements the Driver interface
 	_ drivers.Driver = &Driver{}
+
+	// sshUserByOSPrefix maps operating system slug prefixes to the default
+	// SSH user for images that do not allow root login.  Root remains the
+	// fallback for everything else.
+	sshUserByOSPrefix = map[string]string{
+		"coreos":  "core",
+		"flatcar": "core",
+		"rancher": "rancher",
+	}
+
+	// metroByFacility maps well-known facility codes to their enclosing
+	// metro, for --metal-facility-to-metro.  Facilities are deprecated in
+	// favor of metros.
+	metroByFacility = map[string]string{
+		"am6":  "am",
+		"ch3":  "ch",
+		"da11": "da",
+		"dc13": "dc",
+		"fr2":  "fr",
+		"hk2":  "hk",
+		"la4":  "la",
+		"ny5":  "ny",
+		"ny7":  "ny",
+		"sg1":  "sg",
+		"sv15": "sv",
+		"sy4":  "sy",
+		"tr2":  "tr",
+		"ty11": "ty",
+	}
+
+	// facilityDeprecationWarned keeps the facility deprecation warning to a
+	// single line per process, not one per libmachine poll.
+	facilityDeprecationWarned = false
 )
 
 func argPrefix(f argSuffix) string {
@@ -86,6 +310,8 @@ type Driver struct {
 	*drivers.BaseDriver
 	ApiKey                  string
 	ProjectID               string
+	ProjectName             string
+	OrganizationID          string
 	Plan                    string
 	HardwareReserverationID string
 	Facility                string
@@ -97,11 +323,83 @@ type Driver struct {
 	Tags                    []string
 	CaCertPath              string
 	SSHKeyID                string
-	UserDataFile            string
-	UserAgentPrefix         string
-	SpotInstance            bool
-	SpotPriceMax            float32
-	TerminationTime         *time.Time
+	// SSHKeyOwned records whether the driver created SSHKeyID and may
+	// therefore delete it on Remove.  It must survive serialization since
+	// Remove typically runs in a later process.
+	SSHKeyOwned      bool
+	ExistingSSHKey   string
+	ProjectSSHKeys   bool
+	AdoptExisting    bool
+	CapacityRetry    time.Duration
+	SpotFallback     bool
+	CreatedAt        time.Time
+	SSHKeyLabel      string
+	PostCreateCmd    string
+	Features         []string
+	DeleteOnError    bool
+	BondMode         string
+	UserdataGzip     bool
+	UserdataMerge    bool
+	ProvisionStall   time.Duration
+	ReuseSSHKey      bool
+	TailEvents       bool
+	KeepReservation  bool
+	SpotTermAction   string
+	SkipSSHWait      bool
+	UserDataFile     string
+	UserDataTemplate string
+	UserAgentPrefix  string
+	UserAgentSuffix  string
+	ApiUrl           string
+	HttpsProxy       string
+	ApiRetries       int
+	DeviceJsonOutput string
+	LockDevice       bool
+	AllowAnyOS       bool
+	AlwaysPxe        bool
+	IpxeScriptUrl    string
+	Hostname         string
+	Description      string
+	NoPublicIp       bool
+	IpReservationIds []string
+	GlobalIp         string
+	WaitOnRestart    bool
+	Debug            bool
+	DryRun           bool
+	MaxRps           int
+	Customdata       string
+	ApiTimeout       time.Duration
+	EnableBgp        bool
+	BgpMd5           string
+	BgpSessionID     string
+	NetworkType      string
+	Vlan             string
+	StateCacheTTL    time.Duration
+	ConsumerToken    string
+	NoConsumerToken  bool
+	PowerTimeout     time.Duration
+	SSHWaitTimeout   time.Duration
+	SpotInstance     bool
+	SpotPriceMax     float32
+	TerminationTime  *time.Time
+
+	// cachedState memoizes the last GetState result for StateCacheTTL so
+	// rapid repeated calls within one process make a single API request.
+	cachedState    state.State
+	cachedStateAt  time.Time
+	cachedStateFor string
+
+	// metroSource and facilitySource record where each location value came
+	// from (config file vs flag/env) so the conflict error in PreCreateCheck
+	// can point at both.  They only matter within a single run and are not
+	// serialized.
+	metroSource    string
+	facilitySource string
+
+	// clientFactory, when set, replaces the production client construction
+	// in getClient so tests can point every API call at a stub without a
+	// live token.
+	clientFactory func() *metal.APIClient
 }
 
 // NewDriver is a backward compatible Driver factory method.  Using
@@ -127,31 +425,53 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Authentication Key (deprecated name, use Auth Token)",
 			EnvVar: envPrefix(envApiKey),
 		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argAuthTokenFile),
+			Usage:  "Path to a file holding the Equinix Metal Authentication Token, used when the token flag is empty",
+			EnvVar: envPrefix(envAuthTokenFile),
+		},
 		mcnflag.StringFlag{
 			Name:   argPrefix(argProjectID),
 			Usage:  "Equinix Metal Project Id",
 			EnvVar: envPrefix(envProjectID),
 		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argProjectName),
+			Usage:  "Equinix Metal Project Name, resolved to an Id when no Project Id is given",
+			EnvVar: envPrefix(envProjectName),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argOrganizationID),
+			Usage:  "Equinix Metal Organization Id scoping the Project Name lookup",
+			EnvVar: envPrefix(envOrganizationID),
+		},
 		mcnflag.StringFlag{
 			Name:   argPrefix(argOS),
-			Usage:  "Equinix Metal OS",
-			Value:  defaultOS,
+			Usage:  fmt.Sprintf("Equinix Metal OS (%q is used if unset here and in the config file)", defaultOS),
 			EnvVar: envPrefix(envOS),
+			// We don't set Value so an operating-system entry in the config
+			// file can act as the default; the compiled default only applies
+			// when neither is set.
 		},
 		mcnflag.StringFlag{
 			Name:   argPrefix(argFacilityCode),
-			Usage:  "Equinix Metal facility code",
+			Usage:  "Equinix Metal facility code, or a comma-separated list to fall back through",
 			EnvVar: envPrefix(envFacilityCode),
 		},
 		mcnflag.StringFlag{
 			Name:   argPrefix(argMetroCode),
-			Usage:  fmt.Sprintf("Equinix Metal metro code (%q is used if empty and facility is not set)", defaultMetro),
+			Usage:  fmt.Sprintf("Equinix Metal metro code (%q is used if empty and facility is not set, \"any\" picks the first metro with capacity for the plan)", defaultMetro),
 			EnvVar: envPrefix(envMetroCode),
 			// We don't set Value because Facility was previously required and
 			// defaulted. Existing configurations with "Facility" should not
 			// break. Setting a default metro value would break those
 			// configurations.
 		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argRegion),
+			Usage:  fmt.Sprintf("Cloud-style region name mapped to an Equinix Metal metro (e.g. \"us-east-1\"), --%s wins when both are set", argPrefix(argMetroCode)),
+			EnvVar: envPrefix(envRegion),
+		},
 		mcnflag.StringFlag{
 			Name:   argPrefix(argPlan),
 			Usage:  "Equinix Metal Server Plan",
@@ -160,7 +480,7 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.StringFlag{
 			Name:   argPrefix(argHwId),
-			Usage:  "Equinix Metal Reserved hardware ID",
+			Usage:  fmt.Sprintf("Equinix Metal Reserved hardware ID, or %q to pick any free reservation for the plan", hwReservationNextAvailable),
 			EnvVar: envPrefix(envHwId),
 		},
 		mcnflag.StringFlag{
@@ -174,6 +494,31 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Path to file with cloud-init user-data",
 			EnvVar: envPrefix(envUserdata),
 		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argUserdataInline),
+			Usage:  "Cloud-init user-data passed inline",
+			EnvVar: envPrefix(envUserdataInline),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argUserdataTmpl),
+			Usage:  "Path to a Go text/template rendered to cloud-init user-data with MachineName, Metro, Plan and ProjectID",
+			EnvVar: envPrefix(envUserdataTmpl),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argUserdataMerge),
+			Usage:  fmt.Sprintf("Combine --%s and --%s into one multipart cloud-init archive instead of treating them as exclusive", argPrefix(argUserdata), argPrefix(argUserdataTmpl)),
+			EnvVar: envPrefix(envUserdataMerge),
+		},
+		mcnflag.StringSliceFlag{
+			Name:   argPrefix(argTags),
+			Usage:  "Tags to apply to the created device",
+			EnvVar: envPrefix(envTags),
+		},
+		mcnflag.StringSliceFlag{
+			Name:   argPrefix(argFeatures),
+			Usage:  "Hardware features to request for the device (e.g. tpm), passed through to the API",
+			EnvVar: envPrefix(envFeatures),
+		},
 		mcnflag.BoolFlag{
 			Name:   argPrefix(argSpotInstance),
 			Usage:  "Request a Equinix Metal Spot Instance",
@@ -184,6 +529,21 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "The maximum Equinix Metal Spot Price",
 			EnvVar: envPrefix(envSpotPriceMax),
 		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argSpotPriceMarket),
+			Usage:  "Bid the current market price for a Spot Instance, with no maximum",
+			EnvVar: envPrefix(envSpotPriceMarket),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argSpotTermAction),
+			Usage:  fmt.Sprintf("How a spot device reclaimed by Equinix Metal shows up in state reporting: %q treats a vanished device as powered off, %q reports it as gone", spotTerminationStopped, spotTerminationNone),
+			EnvVar: envPrefix(envSpotTermAction),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argSpotFallback),
+			Usage:  "Retry as an on-demand device when the spot request fails on capacity or price",
+			EnvVar: envPrefix(envSpotFallback),
+		},
 		mcnflag.StringFlag{
 			Name:   argPrefix(argTerminationTime),
 			Usage:  "The Equinix Metal Instance Termination Time",
@@ -194,6 +554,244 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  fmt.Sprintf("Prefix the User-Agent in Equinix Metal API calls with some 'product/version' %s %s", version, driverName),
 			EnvVar: envPrefix(envUAPrefix),
 		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argUASuffix),
+			Usage:  "Append some 'product/version' to the User-Agent in Equinix Metal API calls",
+			EnvVar: envPrefix(envUASuffix),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argConsumerToken),
+			Usage:  "X-Consumer-Token header sent with API calls, overriding the built-in one",
+			EnvVar: envPrefix(envConsumerToken),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argNoConsumerToken),
+			Usage:  "Omit the X-Consumer-Token header, for proxies or staging endpoints that reject it",
+			EnvVar: envPrefix(envNoConsumerToken),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argApiUrl),
+			Usage:  "Equinix Metal API base URL, for private or staging endpoints",
+			EnvVar: envPrefix(envApiUrl),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argHttpsProxy),
+			Usage:  "HTTPS proxy URL for Equinix Metal API calls (HTTPS_PROXY is honored when unset)",
+			EnvVar: envPrefix(envHttpsProxy),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argApiTimeout),
+			Usage:  "Timeout for individual Equinix Metal API requests, e.g. \"30s\"",
+			Value:  defaultApiTimeout.String(),
+			EnvVar: envPrefix(envApiTimeout),
+		},
+		mcnflag.IntFlag{
+			Name:   argPrefix(argApiRetries),
+			Usage:  "Maximum retries for transient Equinix Metal API errors",
+			Value:  3,
+			EnvVar: envPrefix(envApiRetries),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argDeviceJson),
+			Usage:  "Path to write a JSON summary of the created device, \"-\" for stdout",
+			EnvVar: envPrefix(envDeviceJson),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argLockDevice),
+			Usage:  "Lock the device after creation to prevent deletion",
+			EnvVar: envPrefix(envLockDevice),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argAllowAnyOS),
+			Usage:  "Accept any operating system slug the API offers, bypassing the curated distro list",
+			EnvVar: envPrefix(envAllowAnyOS),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argAlwaysPxe),
+			Usage:  "Always boot the device via PXE",
+			EnvVar: envPrefix(envAlwaysPxe),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argIpxeScriptUrl),
+			Usage:  "URL of an iPXE script for netbooting custom images",
+			EnvVar: envPrefix(envIpxeScriptUrl),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argCapacityRetry),
+			Usage:  fmt.Sprintf("Keep retrying device creation for this long when the plan has no capacity, e.g. \"30m\" (checked every %s)", capacityRetryInterval),
+			EnvVar: envPrefix(envCapacityRetry),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argAdoptExisting),
+			Usage:  "Adopt an active device with the same hostname instead of creating a duplicate",
+			EnvVar: envPrefix(envAdoptExisting),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argDeleteOnError),
+			Usage:  "Whether a device left behind by a failed create is deleted (\"true\") or kept for inspection (\"false\")",
+			Value:  "true",
+			EnvVar: envPrefix(envDeleteOnError),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argPostCreateCmd),
+			Usage:  "Shell command to run over SSH once the device answers, failing the create when it exits non-zero",
+			EnvVar: envPrefix(envPostCreateCmd),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argKeepReservation),
+			Usage:  "Leave a device on reserved hardware provisioned when removing the machine, keeping the reservation bound",
+			EnvVar: envPrefix(envKeepReservation),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argTailEvents),
+			Usage:  "Log device events (provisioning steps, errors) while waiting for the device to provision",
+			EnvVar: envPrefix(envTailEvents),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argReuseSSHKey),
+			Usage:  "Reuse an existing user or project SSH key with the same fingerprint instead of uploading a duplicate",
+			EnvVar: envPrefix(envReuseSSHKey),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argSSHKeyLabel),
+			Usage:  "Label template for the uploaded SSH key; {{.MachineName}} and {{.Timestamp}} are expanded (default \"docker machine: <name>\")",
+			EnvVar: envPrefix(envSSHKeyLabel),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argProjectSSHKeys),
+			Usage:  "Attach every existing project SSH key to the device, alongside the driver's own key",
+			EnvVar: envPrefix(envProjectSSHKeys),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argSSHKeyPath),
+			Usage:  "Path to an existing SSH private key to upload and use, instead of generating a fresh one",
+			EnvVar: envPrefix(envSSHKeyPath),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argSSHUser),
+			Usage:  "SSH user for the chosen OS, overriding auto-detection",
+			EnvVar: envPrefix(envSSHUser),
+		},
+		mcnflag.IntFlag{
+			Name:   argPrefix(argSSHPort),
+			Usage:  "SSH port the device listens on",
+			Value:  drivers.DefaultSSHPort,
+			EnvVar: envPrefix(envSSHPort),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argStateCacheTtl),
+			Usage:  "How long GetState results are cached in-process, e.g. \"2s\" (\"0\" to disable)",
+			Value:  defaultStateCacheTTL.String(),
+			EnvVar: envPrefix(envStateCacheTtl),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argWaitOnRestart),
+			Usage:  "Wait for the device to be running and reachable over SSH again after a restart",
+			EnvVar: envPrefix(envWaitOnRestart),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argPowerTimeout),
+			Usage:  "Time to wait for power state changes, e.g. \"5m\"",
+			Value:  defaultPowerTimeout.String(),
+			EnvVar: envPrefix(envPowerTimeout),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argSSHWaitTimeout),
+			Usage:  "Time to wait for SSH after provisioning, e.g. \"10m\" (library default when empty)",
+			EnvVar: envPrefix(envSSHWaitTimeout),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argSkipSSHWait),
+			Usage:  "Finish create once the device is active with an IP, without waiting for SSH (docker-machine provisioning over SSH will likely fail)",
+			EnvVar: envPrefix(envSkipSSHWait),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argHostname),
+			Usage:  "Device hostname, when it should differ from the machine name",
+			EnvVar: envPrefix(envHostname),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argDescription),
+			Usage:  "Free-form description recorded on the device",
+			EnvVar: envPrefix(envDescription),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argNoPublicIp),
+			Usage:  "Provision without a public IP, reachable only over the private network",
+			EnvVar: envPrefix(envNoPublicIp),
+		},
+		mcnflag.StringSliceFlag{
+			Name:   argPrefix(argIpReservations),
+			Usage:  "IP reservation (elastic IP) UUIDs to assign to the device",
+			EnvVar: envPrefix(envIpReservations),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argGlobalIp),
+			Usage:  "UUID of a global anycast IP reservation to assign to the device, reported as the machine IP",
+			EnvVar: envPrefix(envGlobalIp),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argDebug),
+			Usage:  "Log API request metadata and poll timings from this driver, independent of the global debug flag",
+			EnvVar: envPrefix(envDebug),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argDryRun),
+			Usage:  "Validate the configuration and log the device create request without provisioning",
+			EnvVar: envPrefix(envDryRun),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argNetworkType),
+			Usage:  fmt.Sprintf("Network type to convert the device's ports to after provisioning: %s, %s, %s or %s", networkTypeLayer3, networkTypeHybrid, networkTypeLayer2Individual, networkTypeLayer2Bonded),
+			Value:  networkTypeLayer3,
+			EnvVar: envPrefix(envNetworkType),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argProvisionStall),
+			Usage:  "Abort the create when the provisioning percentage stops advancing for this long, e.g. \"10m\"",
+			EnvVar: envPrefix(envProvisionStall),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argUserdataGzip),
+			Usage:  "Gzip and base64-encode the userdata before sending; the instance's cloud-init must support compressed userdata",
+			EnvVar: envPrefix(envUserdataGzip),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argBondMode),
+			Usage:  fmt.Sprintf("Bonding mode for the device's bond interface: %s (LACP, bonded ports) or %s (disbonded ports)", bondMode8023ad, bondModeBalanceTlb),
+			EnvVar: envPrefix(envBondMode),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argVlan),
+			Usage:  "Virtual network to attach the device to after provisioning, as a VLAN UUID or VXLAN number",
+			EnvVar: envPrefix(envVlan),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argEnableBgp),
+			Usage:  "Enable BGP on the device once it is active (the project must have BGP configured)",
+			EnvVar: envPrefix(envEnableBgp),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argBgpMd5),
+			Usage:  "MD5 password used when requesting a local BGP deployment for a project without one",
+			EnvVar: envPrefix(envBgpMd5),
+		},
+		mcnflag.StringFlag{
+			Name:   argPrefix(argCustomdata),
+			Usage:  "Customdata JSON recorded on the device, inline or @path-to-file",
+			EnvVar: envPrefix(envCustomdata),
+		},
+		mcnflag.BoolFlag{
+			Name:   argPrefix(argFacilityToMetro),
+			Usage:  "Map a well-known deprecated facility code to its enclosing metro",
+			EnvVar: envPrefix(envFacilityToMetro),
+		},
+		mcnflag.IntFlag{
+			Name:   argPrefix(argMaxRps),
+			Usage:  "Ceiling on Equinix Metal API requests per second, shared per auth token (default 10, 0 to disable)",
+			Value:  defaultMaxRps,
+			EnvVar: envPrefix(envMaxRps),
+		},
 	}
 }
 
@@ -221,8 +819,21 @@ func (d *Driver) setConfigFromFile() error {
 	}
 	d.Facility = config.Facility
 	d.Metro = config.Metro
+	if d.Facility != "" {
+		d.facilitySource = fmt.Sprintf("config file %s", configFile)
+	}
+	if d.Metro != "" {
+		d.metroSource = fmt.Sprintf("config file %s", configFile)
+	}
 	d.OperatingSystem = config.OS
 	d.ProjectID = config.ProjectID
+	d.Tags = config.Tags
+	if config.SSHKeyID != "" {
+		// a centrally managed project key; the driver does not own it and
+		// must not delete it on Remove
+		d.SSHKeyID = config.SSHKeyID
+		d.SSHKeyOwned = false
+	}
 	return nil
 }
 
@@ -232,23 +843,65 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	}
 	// override config file values with command-line values
 	for k, p := range map[string]*string{
-		argPrefix(argOS):           &d.OperatingSystem,
 		argPrefix(argAuthToken):    &d.ApiKey,
 		argPrefix(argProjectID):    &d.ProjectID,
-		argPrefix(argMetroCode):    &d.Metro,
 		argPrefix(argFacilityCode): &d.Facility,
 		argPrefix(argPlan):         &d.Plan,
 	} {
 		if v := flags.String(k); v != "" {
 			*p = v
+			if k == argPrefix(argFacilityCode) {
+				d.facilitySource = fmt.Sprintf("--%s flag or %s", k, envPrefix(envFacilityCode))
+			}
+		}
+	}
+
+	d.OperatingSystem = resolveOperatingSystem(flags.String(argPrefix(argOS)), d.OperatingSystem)
+
+	configMetro := d.Metro // from the config file, if any
+	flagMetro := flags.String(argPrefix(argMetroCode))
+	flagRegion := flags.String(argPrefix(argRegion))
+	regionMetro := ""
+	if flagRegion != "" {
+		regionMetro = metroForRegion(flagRegion)
+		if flagMetro != "" && flagMetro != regionMetro {
+			log.Warnf("--%s and --%s are both set, using metro %q from --%s", argPrefix(argMetroCode), argPrefix(argRegion), flagMetro, argPrefix(argMetroCode))
 		}
 	}
+	effectiveMetro := flagMetro
+	if effectiveMetro == "" {
+		effectiveMetro = regionMetro
+	}
+	d.Metro = resolveMetro(effectiveMetro, configMetro, d.Facility)
+	switch {
+	case flagMetro != "":
+		d.metroSource = fmt.Sprintf("--%s flag or %s", argPrefix(argMetroCode), envPrefix(envMetroCode))
+	case regionMetro != "":
+		d.metroSource = fmt.Sprintf("--%s flag or %s (region %q)", argPrefix(argRegion), envPrefix(envRegion), flagRegion)
+	case configMetro != "":
+		// metroSource was already set by setConfigFromFile
+	case d.Metro == defaultMetro:
+		d.metroSource = "built-in default"
+	}
 
 	oldApiKey := flags.String(argPrefix(argApiKey))
 
 	if d.ApiKey == "" {
 		d.ApiKey = oldApiKey
 
+		if d.ApiKey == "" {
+			if tokenFile := flags.String(argPrefix(argAuthTokenFile)); tokenFile != "" {
+				raw, err := os.ReadFile(tokenFile)
+				if err != nil {
+					return fmt.Errorf("--%s could not be read: %s", argPrefix(argAuthTokenFile), err)
+				}
+				d.ApiKey = strings.TrimSpace(string(raw))
+				if d.ApiKey == "" {
+					return fmt.Errorf("--%s file %s is empty", argPrefix(argAuthTokenFile), tokenFile)
+				}
+			}
+		}
+
 		if d.ApiKey == "" {
 			return fmt.Errorf("%s driver requires the --%s option", driverName, argPrefix(argAuthToken))
 		}
@@ -256,65 +909,458 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 		log.Warnf("ignoring API Key setting (%s, %s)", argPrefix(argApiKey), envPrefix(envApiKey))
 	}
 
-	if strings.Contains(d.OperatingSystem, "coreos") {
-		d.SSHUser = "core"
+	for prefix, user := range sshUserByOSPrefix {
+		if strings.HasPrefix(d.OperatingSystem, prefix) {
+			d.SSHUser = user
+		}
+	}
+	if sshUser := flags.String(argPrefix(argSSHUser)); sshUser != "" {
+		d.SSHUser = sshUser
+	}
+	d.AdoptExisting = flags.Bool(argPrefix(argAdoptExisting))
+	if capacityRetry := flags.String(argPrefix(argCapacityRetry)); capacityRetry != "" {
+		parsed, err := time.ParseDuration(capacityRetry)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("--%s must be a positive duration, e.g. \"30m\"", argPrefix(argCapacityRetry))
+		}
+		d.CapacityRetry = parsed
+	}
+	d.ProjectSSHKeys = flags.Bool(argPrefix(argProjectSSHKeys))
+	deleteOnError, err := strconv.ParseBool(flags.String(argPrefix(argDeleteOnError)))
+	if err != nil {
+		return fmt.Errorf("--%s must be \"true\" or \"false\"", argPrefix(argDeleteOnError))
+	}
+	d.DeleteOnError = deleteOnError
+	d.PostCreateCmd = flags.String(argPrefix(argPostCreateCmd))
+	d.KeepReservation = flags.Bool(argPrefix(argKeepReservation))
+	d.TailEvents = flags.Bool(argPrefix(argTailEvents))
+	d.ReuseSSHKey = flags.Bool(argPrefix(argReuseSSHKey))
+	d.SSHKeyLabel = flags.String(argPrefix(argSSHKeyLabel))
+	if d.SSHKeyLabel != "" {
+		if _, err := template.New("ssh-key-label").Parse(d.SSHKeyLabel); err != nil {
+			return fmt.Errorf("--%s is not a valid template: %s", argPrefix(argSSHKeyLabel), err)
+		}
+	}
+	d.ExistingSSHKey = flags.String(argPrefix(argSSHKeyPath))
+	if d.ExistingSSHKey != "" {
+		if _, err := os.Stat(d.ExistingSSHKey); err != nil {
+			return fmt.Errorf("--%s private key could not be read: %s", argPrefix(argSSHKeyPath), err)
+		}
+		publicKey, err := os.ReadFile(d.ExistingSSHKey + ".pub")
+		if err != nil {
+			return fmt.Errorf("--%s needs the public key next to the private one: %s", argPrefix(argSSHKeyPath), err)
+		}
+		fields := strings.Fields(string(publicKey))
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "ssh-") && !strings.HasPrefix(fields[0], "ecdsa-") {
+			return fmt.Errorf("--%s: %s.pub does not look like an OpenSSH public key", argPrefix(argSSHKeyPath), d.ExistingSSHKey)
+		}
+	}
+	d.SSHPort = flags.Int(argPrefix(argSSHPort))
+	if d.SSHPort < 1 || d.SSHPort > 65535 {
+		return fmt.Errorf("--%s must be between 1 and 65535", argPrefix(argSSHPort))
+	}
+	powerTimeout, err := time.ParseDuration(flags.String(argPrefix(argPowerTimeout)))
+	if err != nil || powerTimeout <= 0 {
+		return fmt.Errorf("--%s must be a positive duration, e.g. \"5m\"", argPrefix(argPowerTimeout))
+	}
+	d.PowerTimeout = powerTimeout
+	stateCacheTTL, err := time.ParseDuration(flags.String(argPrefix(argStateCacheTtl)))
+	if err != nil || stateCacheTTL < 0 {
+		return fmt.Errorf("--%s must be a non-negative duration, e.g. \"2s\"", argPrefix(argStateCacheTtl))
 	}
-	if strings.Contains(d.OperatingSystem, "rancher") {
-		d.SSHUser = "rancher"
+	d.StateCacheTTL = stateCacheTTL
+	if sshTimeout := flags.String(argPrefix(argSSHWaitTimeout)); sshTimeout != "" {
+		parsed, err := time.ParseDuration(sshTimeout)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("--%s must be a positive duration, e.g. \"10m\"", argPrefix(argSSHWaitTimeout))
+		}
+		d.SSHWaitTimeout = parsed
+	}
+	d.SkipSSHWait = flags.Bool(argPrefix(argSkipSSHWait))
+	if d.SkipSSHWait && d.PostCreateCmd != "" {
+		return fmt.Errorf("--%s and --%s are mutually exclusive, the post-create command runs over SSH", argPrefix(argSkipSSHWait), argPrefix(argPostCreateCmd))
 	}
 
-	d.BillingCycle = flags.String(argPrefix(argBillingCycle))
+	d.BillingCycle = strings.ToLower(flags.String(argPrefix(argBillingCycle)))
+	if d.BillingCycle != "hourly" && d.BillingCycle != "monthly" {
+		return fmt.Errorf("--%s must be one of \"hourly\", \"monthly\"", argPrefix(argBillingCycle))
+	}
 	d.UserAgentPrefix = flags.String(argPrefix(argUAPrefix))
+	d.UserAgentSuffix = flags.String(argPrefix(argUASuffix))
+	d.ConsumerToken = flags.String(argPrefix(argConsumerToken))
+	d.NoConsumerToken = flags.Bool(argPrefix(argNoConsumerToken))
+	if d.NoConsumerToken && d.ConsumerToken != "" {
+		return fmt.Errorf("--%s and --%s are mutually exclusive", argPrefix(argNoConsumerToken), argPrefix(argConsumerToken))
+	}
+	d.ApiUrl = flags.String(argPrefix(argApiUrl))
+	if d.ApiUrl != "" {
+		u, err := url.Parse(d.ApiUrl)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("--%s must be an absolute URL", argPrefix(argApiUrl))
+		}
+	}
+	d.HttpsProxy = flags.String(argPrefix(argHttpsProxy))
+	if d.HttpsProxy != "" {
+		u, err := url.Parse(d.HttpsProxy)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("--%s must be an absolute URL", argPrefix(argHttpsProxy))
+		}
+	}
+	apiTimeout, err := time.ParseDuration(flags.String(argPrefix(argApiTimeout)))
+	if err != nil || apiTimeout <= 0 {
+		return fmt.Errorf("--%s must be a positive duration, e.g. \"30s\"", argPrefix(argApiTimeout))
+	}
+	d.ApiTimeout = apiTimeout
+	d.ApiRetries = flags.Int(argPrefix(argApiRetries))
+	if d.ApiRetries < 0 {
+		return fmt.Errorf("--%s must not be negative", argPrefix(argApiRetries))
+	}
+	d.WaitOnRestart = flags.Bool(argPrefix(argWaitOnRestart))
+	d.DeviceJsonOutput = flags.String(argPrefix(argDeviceJson))
+	d.Hostname = flags.String(argPrefix(argHostname))
+	d.Description = flags.String(argPrefix(argDescription))
+	d.NoPublicIp = flags.Bool(argPrefix(argNoPublicIp))
+	d.IpReservationIds = flags.StringSlice(argPrefix(argIpReservations))
+	d.DryRun = flags.Bool(argPrefix(argDryRun))
+	d.Debug = flags.Bool(argPrefix(argDebug))
+	d.MaxRps = flags.Int(argPrefix(argMaxRps))
+	if d.MaxRps < 0 {
+		return fmt.Errorf("--%s must not be negative", argPrefix(argMaxRps))
+	}
+	if d.Facility != "" {
+		if flags.Bool(argPrefix(argFacilityToMetro)) {
+			if metro, ok := metroByFacility[d.Facility]; ok {
+				log.Infof("Mapping deprecated facility %q to metro %q", d.Facility, metro)
+				d.Metro = metro
+				d.metroSource = d.facilitySource
+				d.Facility = ""
+				d.facilitySource = ""
+			} else {
+				return fmt.Errorf("--%s does not know the metro for facility %q, use --%s", argPrefix(argFacilityToMetro), d.Facility, argPrefix(argMetroCode))
+			}
+		} else if !facilityDeprecationWarned {
+			facilityDeprecationWarned = true
+			log.Warnf("Facilities are deprecated by Equinix Metal, use --%s instead of --%s", argPrefix(argMetroCode), argPrefix(argFacilityCode))
+		}
+	}
+	d.GlobalIp = flags.String(argPrefix(argGlobalIp))
+	if d.NoPublicIp && (len(d.IpReservationIds) > 0 || d.GlobalIp != "") {
+		return fmt.Errorf("--%s and --%s or --%s are mutually exclusive", argPrefix(argNoPublicIp), argPrefix(argIpReservations), argPrefix(argGlobalIp))
+	}
+	d.NetworkType = flags.String(argPrefix(argNetworkType))
+	switch d.NetworkType {
+	case networkTypeLayer3, networkTypeHybrid, networkTypeLayer2Individual, networkTypeLayer2Bonded:
+	default:
+		return fmt.Errorf("--%s must be one of %s, %s, %s, %s", argPrefix(argNetworkType), networkTypeLayer3, networkTypeHybrid, networkTypeLayer2Individual, networkTypeLayer2Bonded)
+	}
+	if stall := flags.String(argPrefix(argProvisionStall)); stall != "" {
+		parsed, err := time.ParseDuration(stall)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("--%s must be a positive duration, e.g. \"10m\"", argPrefix(argProvisionStall))
+		}
+		d.ProvisionStall = parsed
+	}
+	d.UserdataGzip = flags.Bool(argPrefix(argUserdataGzip))
+	d.BondMode = flags.String(argPrefix(argBondMode))
+	switch d.BondMode {
+	case "":
+	case bondMode8023ad:
+		if d.NetworkType == networkTypeLayer2Individual {
+			return fmt.Errorf("--%s %s needs bonded ports, which --%s %s breaks up", argPrefix(argBondMode), bondMode8023ad, argPrefix(argNetworkType), networkTypeLayer2Individual)
+		}
+	case bondModeBalanceTlb:
+		if d.NetworkType != networkTypeLayer2Individual {
+			return fmt.Errorf("--%s %s needs disbonded ports; use --%s %s", argPrefix(argBondMode), bondModeBalanceTlb, argPrefix(argNetworkType), networkTypeLayer2Individual)
+		}
+	default:
+		return fmt.Errorf("--%s must be %s or %s", argPrefix(argBondMode), bondMode8023ad, bondModeBalanceTlb)
+	}
+	d.Vlan = flags.String(argPrefix(argVlan))
+	if d.Vlan != "" && d.NetworkType == networkTypeLayer3 {
+		return fmt.Errorf("--%s requires a Layer 2 capable --%s (%s, %s or %s)", argPrefix(argVlan), argPrefix(argNetworkType), networkTypeHybrid, networkTypeLayer2Individual, networkTypeLayer2Bonded)
+	}
+	d.EnableBgp = flags.Bool(argPrefix(argEnableBgp))
+	d.BgpMd5 = flags.String(argPrefix(argBgpMd5))
+	if d.BgpMd5 != "" && !d.EnableBgp {
+		return fmt.Errorf("--%s requires --%s", argPrefix(argBgpMd5), argPrefix(argEnableBgp))
+	}
+	d.LockDevice = flags.Bool(argPrefix(argLockDevice))
+	d.AllowAnyOS = flags.Bool(argPrefix(argAllowAnyOS))
+	d.AlwaysPxe = flags.Bool(argPrefix(argAlwaysPxe))
+	d.IpxeScriptUrl = flags.String(argPrefix(argIpxeScriptUrl))
+	if strings.Contains(d.OperatingSystem, "custom_ipxe") && d.IpxeScriptUrl == "" {
+		return fmt.Errorf("--%s custom_ipxe requires --%s", argPrefix(argOS), argPrefix(argIpxeScriptUrl))
+	}
+	customdata := flags.String(argPrefix(argCustomdata))
+	if strings.HasPrefix(customdata, "@") {
+		raw, err := os.ReadFile(customdata[1:])
+		if err != nil {
+			return fmt.Errorf("--%s file could not be read: %s", argPrefix(argCustomdata), err)
+		}
+		customdata = string(raw)
+	}
+	if customdata != "" {
+		if err := json.Unmarshal([]byte(customdata), &map[string]interface{}{}); err != nil {
+			return fmt.Errorf("--%s must be a JSON object: %s", argPrefix(argCustomdata), err)
+		}
+	}
+	d.Customdata = customdata
 	d.UserDataFile = flags.String(argPrefix(argUserdata))
+	d.UserData = flags.String(argPrefix(argUserdataInline))
+	d.UserDataTemplate = flags.String(argPrefix(argUserdataTmpl))
+	if d.UserData != "" {
+		// METAL_USERDATA used to mean the file path that METAL_USERDATA_FILE
+		// now holds; catch environments still exporting a path so the path
+		// string is not sent as the cloud-init payload
+		if _, err := os.Stat(d.UserData); err == nil {
+			log.Warnf("--%s (%s) is sent as the userdata content itself, but %q is a path to an existing file; use --%s (%s) to send that file's contents", argPrefix(argUserdataInline), envPrefix(envUserdataInline), d.UserData, argPrefix(argUserdata), envPrefix(envUserdata))
+		}
+	}
+	d.UserdataMerge = flags.Bool(argPrefix(argUserdataMerge))
+	if d.UserdataMerge {
+		if d.UserDataFile == "" || d.UserDataTemplate == "" {
+			return fmt.Errorf("--%s requires both --%s and --%s", argPrefix(argUserdataMerge), argPrefix(argUserdata), argPrefix(argUserdataTmpl))
+		}
+		if d.UserData != "" {
+			return fmt.Errorf("--%s cannot be combined with --%s", argPrefix(argUserdataMerge), argPrefix(argUserdataInline))
+		}
+	} else {
+		userdataSources := 0
+		for _, source := range []string{d.UserDataFile, d.UserData, d.UserDataTemplate} {
+			if source != "" {
+				userdataSources++
+			}
+		}
+		if userdataSources > 1 {
+			return fmt.Errorf("--%s, --%s and --%s are mutually exclusive without --%s", argPrefix(argUserdata), argPrefix(argUserdataInline), argPrefix(argUserdataTmpl), argPrefix(argUserdataMerge))
+		}
+	}
 	d.HardwareReserverationID = flags.String(argPrefix(argHwId))
+	// tags from the config file and the command line are unioned
+	for _, tag := range flags.StringSlice(argPrefix(argTags)) {
+		if !stringInSlice(tag, d.Tags) {
+			d.Tags = append(d.Tags, tag)
+		}
+	}
+	d.Features = flags.StringSlice(argPrefix(argFeatures))
 	d.SpotInstance = flags.Bool(argPrefix(argSpotInstance))
+	if d.SpotInstance && d.HardwareReserverationID != "" {
+		return fmt.Errorf("--%s and --%s are mutually exclusive: reserved hardware is not bid on in the spot market", argPrefix(argSpotInstance), argPrefix(argHwId))
+	}
+	spotPriceMax := flags.String(argPrefix(argSpotPriceMax))
+	if !d.SpotInstance && spotPriceMax != "" {
+		return fmt.Errorf("--%s requires --%s", argPrefix(argSpotPriceMax), argPrefix(argSpotInstance))
+	}
+	d.SpotFallback = flags.Bool(argPrefix(argSpotFallback))
+	if d.SpotFallback && !d.SpotInstance {
+		return fmt.Errorf("--%s requires --%s", argPrefix(argSpotFallback), argPrefix(argSpotInstance))
+	}
+	d.SpotTermAction = flags.String(argPrefix(argSpotTermAction))
+	switch d.SpotTermAction {
+	case "", spotTerminationStopped, spotTerminationNone:
+	default:
+		return fmt.Errorf("--%s must be %q or %q", argPrefix(argSpotTermAction), spotTerminationStopped, spotTerminationNone)
+	}
+	if d.SpotTermAction != "" && !d.SpotInstance {
+		return fmt.Errorf("--%s requires --%s", argPrefix(argSpotTermAction), argPrefix(argSpotInstance))
+	}
 
 	if d.SpotInstance {
-		SpotPriceMax := flags.String(argPrefix(argSpotPriceMax))
-		if SpotPriceMax == "" {
+		if spotPriceMax == "" {
+			if !flags.Bool(argPrefix(argSpotPriceMarket)) {
+				return fmt.Errorf("--%s requires --%s, or --%s to bid without a maximum", argPrefix(argSpotInstance), argPrefix(argSpotPriceMax), argPrefix(argSpotPriceMarket))
+			}
 			d.SpotPriceMax = -1
 		} else {
-			SpotPriceMax, err := strconv.ParseFloat(SpotPriceMax, 32)
+			parsed, err := strconv.ParseFloat(spotPriceMax, 32)
 			if err != nil {
-				return err
+				return fmt.Errorf("--%s must be a number: %s", argPrefix(argSpotPriceMax), err)
+			}
+			if math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+				return fmt.Errorf("--%s must be a finite number", argPrefix(argSpotPriceMax))
 			}
-			d.SpotPriceMax = float32(SpotPriceMax)
+			if parsed <= 0 {
+				return fmt.Errorf("--%s must be greater than zero", argPrefix(argSpotPriceMax))
+			}
+			if parsed > maxSpotPriceCeiling {
+				return fmt.Errorf("--%s %v exceeds the sanity ceiling of %v per hour", argPrefix(argSpotPriceMax), parsed, maxSpotPriceCeiling)
+			}
+			d.SpotPriceMax = float32(parsed)
 		}
+	}
+
+	// scheduled termination works for on-demand devices too, not only spot
+	terminationTime, err := parseTerminationTime(flags.String(argPrefix(argTerminationTime)), time.Now())
+	if err != nil {
+		return err
+	}
+	d.TerminationTime = terminationTime
+
+	d.ProjectName = flags.String(argPrefix(argProjectName))
+	d.OrganizationID = flags.String(argPrefix(argOrganizationID))
+	if d.ProjectID == "" && d.ProjectName == "" {
+		return fmt.Errorf("%s driver requires the --%s or --%s option", driverName, argPrefix(argProjectID), argPrefix(argProjectName))
+	}
+
+	return nil
+}
 
-		TerminationTime := flags.String(argPrefix(argTerminationTime))
-		if TerminationTime == "" {
-			d.TerminationTime = nil
+// parseTerminationTime turns the --metal-termination-time value into a UTC
+// timestamp.  It accepts a relative duration like "+2h", an RFC3339
+// timestamp in any zone, or anything strtotime understands (e.g. "tomorrow
+// 5pm"), and rejects times that are not in the future.
+func parseTerminationTime(value string, now time.Time) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var t time.Time
+	switch {
+	case strings.HasPrefix(value, "+"):
+		duration, err := time.ParseDuration(value[1:])
+		if err != nil {
+			return nil, terminationTimeError(value, err)
+		}
+		t = now.Add(duration)
+	default:
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err == nil {
+			t = parsed
 		} else {
-			Timestamp, err := strtotime.Parse(TerminationTime, time.Now().Unix())
+			timestamp, err := strtotime.Parse(value, now.Unix())
 			if err != nil {
-				return err
+				return nil, terminationTimeError(value, err)
 			}
-			if Timestamp <= time.Now().Unix() {
-				return fmt.Errorf("--%s cannot be in the past", argPrefix(argTerminationTime))
-			}
-			t := time.Unix(Timestamp, 0)
-			d.TerminationTime = &t
+			t = time.Unix(timestamp, 0)
 		}
 	}
 
-	if d.ProjectID == "" {
-		return fmt.Errorf("%s driver requires the --%s option", driverName, argPrefix(argProjectID))
+	t = t.UTC()
+	if !t.After(now) {
+		return nil, fmt.Errorf("--%s %q resolves to %s, which is not in the future", argPrefix(argTerminationTime), value, t.Format(time.RFC3339))
+	}
+	return &t, nil
+}
+
+func terminationTimeError(value string, err error) error {
+	return fmt.Errorf("--%s %q is not a relative duration like \"+2h\", an RFC3339 timestamp like %q, or a natural date: %s",
+		argPrefix(argTerminationTime), value, "2024-05-01T17:00:00Z", err)
+}
+
+// debugLogf logs at Info level when --metal-debug is set, so driver-level
+// diagnostics do not require docker-machine's global debug flag, and at
+// Debug level otherwise.
+func (d *Driver) debugLogf(format string, args ...interface{}) {
+	if d.Debug {
+		log.Infof(format, args...)
+		return
 	}
+	log.Debugf(format, args...)
+}
 
+// validateAuthToken makes a lightweight API call before any heavier
+// validation so a bad token fails fast with a clear message instead of
+// surfacing as an OS-flavors or plans error.
+func (d *Driver) validateAuthToken(client *metal.APIClient) error {
+	_, resp, err := client.UsersApi.FindCurrentUser(context.TODO()).Execute()
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("authentication failed: check your --%s", argPrefix(argAuthToken))
+		}
+		return err
+	}
 	return nil
 }
 
+// resolveOperatingSystem decides the OS slug with the same precedence as
+// resolveMetro: flag or env var > config file > the compiled defaultOS.
+func resolveOperatingSystem(flagValue, configValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if configValue != "" {
+		return configValue
+	}
+	return defaultOS
+}
+
+// metroByRegion maps cloud-provider style region names to the Equinix Metal
+// metro nearest to them, easing migration from drivers configured with an
+// AWS-style region. The mapping is best effort; names not listed here are
+// passed through unchanged so a real metro code also works with --region,
+// and validateMetro rejects anything the API does not know.
+var metroByRegion = map[string]string{
+	"us-east-1":      "ny",
+	"us-east-2":      "ch",
+	"us-west-1":      "sv",
+	"us-west-2":      "se",
+	"ca-central-1":   "tr",
+	"sa-east-1":      "sp",
+	"eu-west-1":      "ld",
+	"eu-west-2":      "ld",
+	"eu-west-3":      "pa",
+	"eu-central-1":   "fr",
+	"ap-southeast-1": "sg",
+	"ap-southeast-2": "sy",
+	"ap-northeast-1": "ty",
+	"ap-northeast-2": "sl",
+	"ap-east-1":      "hk",
+}
+
+// metroForRegion translates a --region value into a metro code, leaving
+// values without a known alias unchanged.
+func metroForRegion(region string) string {
+	region = strings.ToLower(region)
+	if metro, ok := metroByRegion[region]; ok {
+		return metro
+	}
+	return region
+}
+
+// resolveMetro is the single place deciding which metro a device lands in.
+// Precedence: flag or env var > config file > defaultMetro, where the
+// built-in default only applies when no facility was requested either, so
+// facility-only configurations keep working.
+func resolveMetro(flagValue, configValue, facility string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if configValue != "" {
+		return configValue
+	}
+	if facility == "" {
+		return defaultMetro
+	}
+	return ""
+}
+
 func (d *Driver) GetSSHHostname() (string, error) {
 	return d.GetIP()
 }
 
 func (d *Driver) PreCreateCheck() error {
+	if err := d.validateAuthToken(d.getClient()); err != nil {
+		return err
+	}
+
+	if d.ProjectID == "" && d.ProjectName != "" {
+		if err := d.resolveProjectID(d.getClient()); err != nil {
+			return err
+		}
+	}
+
 	if d.UserDataFile != "" {
 		if _, err := os.Stat(d.UserDataFile); os.IsNotExist(err) {
 			return fmt.Errorf("user-data file %s could not be found", d.UserDataFile)
 		}
 	}
 
+	if d.UserDataTemplate != "" {
+		if _, err := os.Stat(d.UserDataTemplate); os.IsNotExist(err) {
+			return fmt.Errorf("user-data template %s could not be found", d.UserDataTemplate)
+		}
+	}
+
 	flavors, err := d.getOsFlavors()
 	if err != nil {
 		return err
@@ -323,18 +1369,66 @@ func (d *Driver) PreCreateCheck() error {
 		return fmt.Errorf("specified --%s not one of %v", argPrefix(argOS), strings.Join(flavors, ", "))
 	}
 
-	if d.Metro == "" && d.Facility == "" {
-		d.Metro = defaultMetro
-	}
+	client := d.getClient()
 
+	// A facility alongside a metro is treated as a refinement: when the
+	// facility really sits in that metro the create request targets the
+	// facility (the more specific of the two), otherwise the conflict is
+	// reported with where each value came from.
 	if d.Metro != "" && d.Facility != "" {
-		return fmt.Errorf("facility and metro can not be used together")
+		facilities, _, err := client.FacilitiesApi.FindFacilities(context.TODO()).Execute()
+		if err != nil {
+			return err
+		}
+		if facilityRefinesMetro(facilities.Facilities, d.Facility, d.Metro) {
+			log.Debugf("facility %s is within metro %s, targeting the facility", d.Facility, d.Metro)
+			d.Metro = ""
+			d.metroSource = ""
+		} else {
+			metroSource, facilitySource := d.metroSource, d.facilitySource
+			if metroSource == "" {
+				metroSource = "unknown source"
+			}
+			if facilitySource == "" {
+				facilitySource = "unknown source"
+			}
+			return fmt.Errorf("facility %q is not in metro %q and the two can not be combined otherwise: metro set via %s, facility set via %s", d.Facility, d.Metro, metroSource, facilitySource)
+		}
 	}
 
-	client := d.getClient()
+	if err := validatePlan(client, d.Plan); err != nil {
+		return err
+	}
+
+	if d.Vlan != "" {
+		if err := d.validateVlan(client); err != nil {
+			return err
+		}
+	}
+
+	if d.GlobalIp != "" {
+		if err := d.validateGlobalIp(client); err != nil {
+			return err
+		}
+	}
+
+	if d.Metro == anyLocation {
+		if err := d.pickMetroWithCapacity(client); err != nil {
+			return err
+		}
+	}
 
 	if d.Metro != "" {
-		return validateMetro(client, d.Metro)
+		if err := validateMetro(client, d.Metro); err != nil {
+			return err
+		}
+		if err := validateCapacity(client, d.Plan, d.Metro); err != nil {
+			return err
+		}
+		if d.SpotInstance {
+			return d.checkSpotMarketPrice(client)
+		}
+		return nil
 	}
 
 	return validateFacility(client, d.Facility)
@@ -346,8 +1440,16 @@ type DeviceCreator interface {
 	SetHostname(string)
 	SetUserdata(string)
 	SetTags([]string)
+	SetDescription(string)
+	SetCustomdata(map[string]interface{})
+	SetIpAddresses([]metalv1.IPAddress)
 	SetHardwareReservationId(string)
+	SetFeatures([]string)
+	SetProjectSshKeys([]string)
+	SetUserSshKeys([]string)
 	SetBillingCycle(metalv1.DeviceCreateInputBillingCycle)
+	SetAlwaysPxe(bool)
+	SetIpxeScriptUrl(string)
 	SetSpotInstance(bool)
 	SetSpotPriceMax(float32)
 	SetTerminationTime(time.Time)
@@ -361,39 +1463,188 @@ type OneOfDeviceCreator interface {
 var _ DeviceCreator = (*metal.DeviceCreateInMetroInput)(nil)
 var _ DeviceCreator = (*metal.DeviceCreateInFacilityInput)(nil)
 
-func (d *Driver) Create() error {
-	var userdata string
+// prepareUserdata assembles the userdata to send with the create request
+// from the configured inline value, file or template, applying compression
+// and the API size limit.
+func (d *Driver) prepareUserdata() (string, error) {
+	userdata := d.UserData
 	if d.UserDataFile != "" {
 		buf, err := os.ReadFile(d.UserDataFile)
 		if err != nil {
-			return err
+			return "", err
 		}
 		userdata = string(buf)
 	}
+	if d.UserDataTemplate != "" {
+		rendered, err := d.renderUserdataTemplate()
+		if err != nil {
+			return "", err
+		}
+		if d.UserdataMerge {
+			merged, err := mergeUserdata(userdata, rendered)
+			if err != nil {
+				return "", err
+			}
+			userdata = merged
+		} else {
+			userdata = rendered
+		}
+	}
+	if d.UserdataGzip && userdata != "" {
+		compressed, err := compressUserdata(userdata)
+		if err != nil {
+			return "", err
+		}
+		if compressed == userdata {
+			log.Warnf("userdata did not shrink under gzip, sending it unmodified")
+		}
+		userdata = compressed
+	}
+	if len(userdata) > maxUserdataSize {
+		return "", fmt.Errorf("userdata is %d bytes, over the %d byte Equinix Metal limit; trim the cloud-init config or fetch the bulk of it from a URL", len(userdata), maxUserdataSize)
+	}
+	return userdata, nil
+}
+
+func (d *Driver) Create() error {
+	userdata, err := d.prepareUserdata()
+	if err != nil {
+		return err
+	}
+
+	if d.AdoptExisting && !d.DryRun {
+		adopted, err := d.adoptExistingDevice(d.getClient())
+		if err != nil {
+			return err
+		}
+		if adopted {
+			return nil
+		}
+	}
+
+	if d.SSHKeyID == "" && !d.DryRun {
+		log.Info("Creating SSH key...")
+
+		// createSSHKey records on SSHKeyOwned whether the key was uploaded
+		// by this driver or an existing project key was reused
+		key, err := d.createSSHKey()
+		if err != nil {
+			return err
+		}
+
+		d.SSHKeyID = key.GetId()
+	}
 
-	log.Info("Creating SSH key...")
+	client := d.getClient()
 
-	key, err := d.createSSHKey()
+	createRequest, err := d.buildCreateRequest(client, userdata)
 	if err != nil {
+		// the SSH key may already be uploaded at this point; don't orphan it
+		d.cleanupFailedCreate(client)
 		return err
 	}
 
-	d.SSHKeyID = key.GetId()
+	if d.DryRun {
+		if userdata != "" {
+			if in := createRequest.DeviceCreateInMetroInput; in != nil {
+				in.SetUserdata("(redacted)")
+			}
+			if in := createRequest.DeviceCreateInFacilityInput; in != nil {
+				in.SetUserdata("(redacted)")
+			}
+		}
+		raw, err := json.MarshalIndent(createRequest, "", "  ")
+		if err != nil {
+			return err
+		}
+		log.Infof("Dry run, device create request that would be sent to project %s:\n%s", d.ProjectID, raw)
+		return nil
+	}
 
+	log.Info("Provisioning Equinix Metal server...")
+	capacityDeadline := time.Now().Add(d.CapacityRetry)
+	spotFellBack := false
+	var newDevice *metal.Device
+	for {
+		var err error
+		newDevice, _, err = client.DevicesApi.CreateDevice(context.TODO(), d.ProjectID).CreateDeviceRequest(createRequest).Execute()
+		if err == nil {
+			break
+		}
+		err = enrichApiError(err)
+
+		// the uploaded SSH key stays in place across capacity retries so the
+		// next attempt can reuse it
+		if d.CapacityRetry > 0 && isCapacityError(err) && time.Now().Add(capacityRetryInterval).Before(capacityDeadline) {
+			log.Infof("No capacity for %s, retrying in %s: %s", d.Plan, capacityRetryInterval, err)
+			time.Sleep(capacityRetryInterval)
+			continue
+		}
+
+		if d.SpotFallback && !spotFellBack && (isCapacityError(err) || strings.Contains(strings.ToLower(err.Error()), "price")) {
+			spotFellBack = true
+			if in := createRequest.DeviceCreateInMetroInput; in != nil {
+				in.SpotInstance = nil
+				in.SpotPriceMax = nil
+			}
+			if in := createRequest.DeviceCreateInFacilityInput; in != nil {
+				in.SpotInstance = nil
+				in.SpotPriceMax = nil
+			}
+			log.Warnf("Spot request failed (%s); falling back to an on-demand device billed at the full %s rate", err, d.BillingCycle)
+			continue
+		}
+
+		log.Errorf("device could not be created: %s", err)
+
+		//cleanup ssh keys if device failed
+		if d.SSHKeyOwned {
+			resp, keyErr := client.SSHKeysApi.DeleteSSHKey(context.TODO(), d.SSHKeyID).Execute()
+			if keyErr := ignoreStatusCodes(resp, keyErr, http.StatusForbidden, http.StatusNotFound); keyErr != nil {
+				log.Errorf("ssh-key could not be deleted: %s", keyErr)
+				return keyErr
+			}
+		}
+		return err
+	}
+	t0 := time.Now()
+
+	d.DeviceID = newDevice.GetId()
+	d.CreatedAt = newDevice.GetCreatedAt()
+
+	// any failure from here on leaves a created device and an uploaded SSH
+	// key behind, so clean both up best-effort before returning
+	if err := d.finishCreate(client, t0); err != nil {
+		d.cleanupFailedCreate(client)
+		return err
+	}
+
+	return nil
+}
+
+// buildCreateRequest assembles the device create request from the driver's
+// configuration.  It makes no mutating API calls, so a failed build leaves
+// nothing to clean up.
+func (d *Driver) buildCreateRequest(client *metal.APIClient, userdata string) (metal.CreateDeviceRequest, error) {
 	hardwareReservationId := ""
 	//check if hardware reservation requested
 	if d.HardwareReserverationID != "" {
 		hardwareReservationId = d.HardwareReserverationID
+		if hardwareReservationId == hwReservationNextAvailable {
+			reserved, err := d.nextAvailableHardwareReservation(client)
+			if err != nil {
+				return metal.CreateDeviceRequest{}, err
+			}
+			hardwareReservationId = reserved
+		}
 	}
 
-	client := d.getClient()
-
 	var dc DeviceCreator
 	var createRequest metal.CreateDeviceRequest
 
 	if d.Facility != "" {
 		dc = &metal.DeviceCreateInFacilityInput{
-			Facility: []string{d.Facility},
+			Facility: strings.Split(d.Facility, ","),
 		}
 		createRequest = metal.CreateDeviceRequest{DeviceCreateInFacilityInput: dc.(*metal.DeviceCreateInFacilityInput)}
 	} else {
@@ -403,91 +1654,1032 @@ func (d *Driver) Create() error {
 		createRequest = metal.CreateDeviceRequest{DeviceCreateInMetroInput: dc.(*metal.DeviceCreateInMetroInput)}
 	}
 
-	dc.SetHostname(d.MachineName)
+	hostname := d.MachineName
+	if d.Hostname != "" {
+		hostname = d.Hostname
+	}
+	dc.SetHostname(hostname)
 	dc.SetPlan(d.Plan)
 	dc.SetHardwareReservationId(hardwareReservationId)
 	dc.SetOperatingSystem(d.OperatingSystem)
 	dc.SetBillingCycle(metalv1.DeviceCreateInputBillingCycle(d.BillingCycle))
 	dc.SetUserdata(userdata)
 	dc.SetTags(d.Tags)
-	dc.SetSpotInstance(d.SpotInstance)
-	dc.SetSpotPriceMax(d.SpotPriceMax)
+	if len(d.Features) > 0 {
+		dc.SetFeatures(d.Features)
+	}
+	if d.Description != "" {
+		dc.SetDescription(d.Description)
+	}
+	if d.Customdata != "" {
+		customdata := map[string]interface{}{}
+		// validated in SetConfigFromFlags
+		if err := json.Unmarshal([]byte(d.Customdata), &customdata); err != nil {
+			return metal.CreateDeviceRequest{}, err
+		}
+		dc.SetCustomdata(customdata)
+	}
+	reservations := d.IpReservationIds
+	if d.GlobalIp != "" {
+		reservations = append(append([]string{}, reservations...), d.GlobalIp)
+	}
+	if d.NoPublicIp {
+		private := metal.IPADDRESSADDRESSFAMILY__4
+		public := false
+		dc.SetIpAddresses([]metal.IPAddress{{AddressFamily: &private, Public: &public}})
+	} else if len(reservations) > 0 {
+		family := metal.IPADDRESSADDRESSFAMILY__4
+		public := true
+		dc.SetIpAddresses([]metal.IPAddress{{AddressFamily: &family, Public: &public, IpReservations: reservations}})
+	}
+	if d.ProjectSSHKeys {
+		keys, _, err := client.SSHKeysApi.FindProjectSSHKeys(context.TODO(), d.ProjectID).Execute()
+		if err != nil {
+			return metal.CreateDeviceRequest{}, err
+		}
+		ids := make([]string, 0, len(keys.SshKeys))
+		for _, key := range keys.SshKeys {
+			ids = append(ids, key.GetId())
+		}
+		dc.SetProjectSshKeys(ids)
+		if d.SSHKeyID != "" {
+			// listing project keys makes the key set explicit, so the
+			// driver's own key must be named to stay attached
+			dc.SetUserSshKeys([]string{d.SSHKeyID})
+		}
+	}
+	if d.AlwaysPxe {
+		dc.SetAlwaysPxe(d.AlwaysPxe)
+	}
+	if d.IpxeScriptUrl != "" {
+		dc.SetIpxeScriptUrl(d.IpxeScriptUrl)
+	}
+	// spot fields are omitted entirely for on-demand devices; the API treats
+	// a present spot_price_max (even the -1 market-bid sentinel) as a bid
+	if d.SpotInstance {
+		dc.SetSpotInstance(true)
+		if d.SpotPriceMax > 0 {
+			dc.SetSpotPriceMax(d.SpotPriceMax)
+		}
+	}
 	if d.TerminationTime != nil {
 		dc.SetTerminationTime(*d.TerminationTime)
 	}
 
-	log.Info("Provisioning Equinix Metal server...")
-	newDevice, _, err := client.DevicesApi.CreateDevice(context.TODO(), d.ProjectID).CreateDeviceRequest(createRequest).Execute()
+	return createRequest, nil
+}
+
+// cloudInitContentType maps a userdata document to the MIME type cloud-init
+// expects for it inside a multipart archive, judged by the document's first
+// line the same way cloud-init itself does.
+func cloudInitContentType(doc string) (string, error) {
+	firstLine := strings.TrimSpace(strings.SplitN(doc, "\n", 2)[0])
+	switch {
+	case strings.HasPrefix(firstLine, "#cloud-config"):
+		return "text/cloud-config", nil
+	case strings.HasPrefix(firstLine, "#!"):
+		return "text/x-shellscript", nil
+	case strings.HasPrefix(firstLine, "#include"):
+		return "text/x-include-url", nil
+	case strings.HasPrefix(firstLine, "#cloud-boothook"):
+		return "text/cloud-boothook", nil
+	case strings.HasPrefix(firstLine, "#part-handler"):
+		return "text/part-handler", nil
+	}
+	return "", fmt.Errorf("first line %q is not a recognized cloud-init header (expected #cloud-config, #!, #include, #cloud-boothook or #part-handler)", firstLine)
+}
+
+// mergeUserdata combines userdata documents into one multipart/mixed archive
+// in the format cloud-init consumes, the file content first so the rendered
+// template can override it.  Every part must open with a recognized
+// cloud-init header or the merge is rejected.
+func mergeUserdata(parts ...string) (string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, part := range parts {
+		contentType, err := cloudInitContentType(part)
+		if err != nil {
+			return "", fmt.Errorf("--%s: %s", argPrefix(argUserdataMerge), err)
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", fmt.Sprintf("%s; charset=\"utf-8\"", contentType))
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Transfer-Encoding", "7bit")
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write([]byte(part)); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	envelope := &bytes.Buffer{}
+	fmt.Fprintf(envelope, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n", writer.Boundary())
+	fmt.Fprintf(envelope, "MIME-Version: 1.0\r\n\r\n")
+	envelope.Write(body.Bytes())
+	return envelope.String(), nil
+}
+
+// compressUserdata gzips and base64-encodes userdata so large cloud-init
+// configs fit under the API's size cap.  Content that does not shrink (for
+// example an already-compressed payload) is passed through untouched so it
+// is not needlessly wrapped in an encoding the instance has to undo.
+func compressUserdata(userdata string) (string, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write([]byte(userdata)); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(encoded) >= len(userdata) {
+		return userdata, nil
+	}
+	return encoded, nil
+}
+
+// selectIPAddress picks the address docker-machine should manage the device
+// over.  The order is deterministic even when a device carries several
+// matching addresses: a requested anycast IP wins, then the API's management
+// address, then the first matching IPv4 in the listing.
+func (d *Driver) selectIPAddress(ips []metal.IPAssignment) string {
+	management := ""
+	first := ""
+	for _, ip := range ips {
+		if ip.GetPublic() != !d.NoPublicIp || ip.GetAddressFamily() != 4 {
+			continue
+		}
+		if d.GlobalIp != "" && ip.GetGlobalIp() {
+			return ip.GetAddress()
+		}
+		if management == "" && ip.GetManagement() {
+			management = ip.GetAddress()
+		}
+		if first == "" {
+			first = ip.GetAddress()
+		}
+	}
+	if management != "" {
+		return management
+	}
+	return first
+}
+
+// adoptExistingDevice looks for an active device in the project carrying the
+// hostname this machine would be created with, typically left behind by a
+// partially failed Create, and adopts it instead of provisioning a duplicate.
+// It reports whether a device was adopted.
+func (d *Driver) adoptExistingDevice(client *metal.APIClient) (bool, error) {
+	hostname := d.MachineName
+	if d.Hostname != "" {
+		hostname = d.Hostname
+	}
+
+	devices, _, err := client.DevicesApi.FindProjectDevices(context.TODO(), d.ProjectID).Hostname(hostname).Execute()
 	if err != nil {
-		log.Errorf("device could not be created: %s", err)
+		return false, enrichApiError(err)
+	}
 
-		//cleanup ssh keys if device failed
-		if resp, err := client.SSHKeysApi.DeleteSSHKey(context.TODO(), d.SSHKeyID).Execute(); ignoreStatusCodes(resp, err, http.StatusForbidden, http.StatusNotFound) != nil {
-			log.Errorf("ssh-key could not be deleted: %s", err)
+	for _, device := range devices.GetDevices() {
+		if device.GetHostname() != hostname || device.GetState() != metal.DEVICESTATE_ACTIVE {
+			continue
+		}
+
+		d.DeviceID = device.GetId()
+		d.IPAddress = d.selectIPAddress(device.GetIpAddresses())
+		log.Infof("Adopting existing device %s (IP %s) instead of creating a duplicate", d.DeviceID, d.IPAddress)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// waitForIP polls the device until the API reports an address the machine
+// can be managed over, storing it on the driver.
+func (d *Driver) waitForIP(client *metal.APIClient) error {
+	for {
+		device, _, err := client.DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+		if err != nil {
 			return err
 		}
+
+		d.IPAddress = d.selectIPAddress(device.GetIpAddresses())
+		if d.IPAddress != "" {
+			return nil
+		}
+
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// finishCreate waits for the created device to get an IP address, finish
+// provisioning, and answer SSH, then applies the post-create options.
+func (d *Driver) finishCreate(client *metal.APIClient, t0 time.Time) error {
+	if err := d.waitForIP(client); err != nil {
 		return err
 	}
-	t0 := time.Now()
 
-	d.DeviceID = newDevice.GetId()
+	log.Infof("Created device ID %s, IP address %s",
+		d.DeviceID,
+		d.IPAddress)
 
-	for {
-		newDevice, _, err = client.DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if err := d.waitForProvisioning(); err != nil {
+		return err
+	}
+
+	log.Debugf("Provision time: %v.", time.Since(t0))
+
+	if d.SkipSSHWait {
+		log.Warnf("--%s is set, not waiting for SSH; docker-machine provisioning will likely fail if it needs to reach sshd", argPrefix(argSkipSSHWait))
+	} else {
+		log.Debug("Waiting for SSH...")
+		if err := d.waitForSSH(); err != nil {
+			return err
+		}
+	}
+
+	if d.PostCreateCmd != "" {
+		log.Infof("Running post-create command: %s", d.PostCreateCmd)
+		output, err := drivers.RunSSHCommandFromDriver(d, d.PostCreateCmd)
+		if output != "" {
+			log.Info(output)
+		}
+		if err != nil {
+			return fmt.Errorf("post-create command failed: %s", err)
+		}
+	}
+
+	if d.NetworkType != "" && d.NetworkType != networkTypeLayer3 {
+		if err := d.convertNetworkType(client); err != nil {
+			return err
+		}
+	}
+
+	if d.BondMode != "" {
+		if err := d.applyBondMode(client); err != nil {
+			return err
+		}
+	}
+
+	if d.Vlan != "" {
+		if err := d.attachVlan(client); err != nil {
+			return err
+		}
+	}
+
+	if d.EnableBgp {
+		if err := d.enableBgp(client); err != nil {
+			return err
+		}
+	}
+
+	if d.LockDevice {
+		log.Info("Locking device...")
+		locked := true
+		update := metal.DeviceUpdateInput{Locked: &locked}
+		if _, _, err := client.DevicesApi.UpdateDevice(context.TODO(), d.DeviceID).DeviceUpdateInput(update).Execute(); err != nil {
+			return err
+		}
+	}
+
+	if d.DeviceJsonOutput != "" {
+		// the device is provisioned and healthy by now; a local file-write
+		// problem must not fail the create and have the device deleted
+		// under --metal-delete-on-error
+		if err := d.writeDeviceSummary(); err != nil {
+			log.Warnf("could not write the device summary to %s: %s", d.DeviceJsonOutput, err)
+		}
+	}
+
+	return nil
+}
+
+// cleanupFailedCreate best-effort deletes the device and the driver-owned
+// SSH key after a failed create so the resources don't keep billing.  With
+// --metal-delete-on-error=false both are kept so the user can SSH in and
+// inspect the half-provisioned device.
+func (d *Driver) cleanupFailedCreate(client *metal.APIClient) {
+	if !d.DeleteOnError {
+		if d.DeviceID != "" {
+			log.Warnf("Keeping device %s after the failed create; it continues to bill until deleted", d.DeviceID)
+		}
+		return
+	}
+	if d.DeviceID != "" {
+		log.Infof("Cleaning up device %s after failed create...", d.DeviceID)
+		resp, err := client.DevicesApi.DeleteDevice(context.TODO(), d.DeviceID).Execute()
+		if err := ignoreStatusCodes(resp, err, http.StatusForbidden, http.StatusNotFound); err != nil {
+			log.Errorf("device could not be deleted: %s", err)
+		}
+	}
+	if d.SSHKeyOwned {
+		resp, err := client.SSHKeysApi.DeleteSSHKey(context.TODO(), d.SSHKeyID).Execute()
+		if err := ignoreStatusCodes(resp, err, http.StatusForbidden, http.StatusNotFound); err != nil {
+			log.Errorf("ssh-key could not be deleted: %s", err)
+		}
+	}
+}
+
+// DeviceDetails is a stable snapshot of the provisioned device for inventory
+// tooling, so callers do not have to depend on the metalv1 SDK types.
+type DeviceDetails struct {
+	ID              string   `json:"id"`
+	Hostname        string   `json:"hostname"`
+	State           string   `json:"state"`
+	Plan            string   `json:"plan"`
+	Metro           string   `json:"metro,omitempty"`
+	Facility        string   `json:"facility,omitempty"`
+	OperatingSystem string   `json:"operating_system"`
+	BillingCycle    string   `json:"billing_cycle"`
+	Tags            []string `json:"tags,omitempty"`
+}
+
+// GetDeviceDetails fetches the device's current metadata from the API and
+// maps it into the exported DeviceDetails struct.
+func (d *Driver) GetDeviceDetails() (*DeviceDetails, error) {
+	if d.DeviceID == "" {
+		return nil, fmt.Errorf("no device has been created for machine %q", d.MachineName)
+	}
+
+	device, _, err := d.getClient().DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if err != nil {
+		return nil, enrichApiError(err)
+	}
+
+	plan := device.GetPlan()
+	metro := device.GetMetro()
+	facility := device.GetFacility()
+	operatingSystem := device.GetOperatingSystem()
+
+	return &DeviceDetails{
+		ID:              device.GetId(),
+		Hostname:        device.GetHostname(),
+		State:           string(device.GetState()),
+		Plan:            plan.GetSlug(),
+		Metro:           metro.GetCode(),
+		Facility:        facility.GetCode(),
+		OperatingSystem: operatingSystem.GetSlug(),
+		BillingCycle:    device.GetBillingCycle(),
+		Tags:            device.GetTags(),
+	}, nil
+}
+
+// ManagedDevice identifies a device in the project that this driver
+// provisioned.
+type ManagedDevice struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+}
+
+// ListManagedDevices returns the project's devices that were provisioned by
+// docker-machine, for external cleanup tooling whose machine store was lost.
+// A device counts as managed when an SSH key labeled with the
+// sshKeyLabelPrefix convention ("docker machine: <hostname>") matches the
+// device's hostname.  The driver's own uploads are user-scoped keys, so the
+// current user's keys are scanned alongside the project's; keys renamed via
+// --metal-ssh-key-label are not recognized.
+func (d *Driver) ListManagedDevices() ([]ManagedDevice, error) {
+	client := d.getClient()
+
+	userKeys, _, err := client.SSHKeysApi.FindSSHKeys(context.TODO()).Execute()
+	if err != nil {
+		return nil, enrichApiError(err)
+	}
+	projectKeys, _, err := client.SSHKeysApi.FindProjectSSHKeys(context.TODO(), d.ProjectID).Execute()
+	if err != nil {
+		return nil, enrichApiError(err)
+	}
+	hostnames := map[string]bool{}
+	for _, keys := range []*metal.SSHKeyList{userKeys, projectKeys} {
+		for _, key := range keys.SshKeys {
+			if name, ok := strings.CutPrefix(key.GetLabel(), sshKeyLabelPrefix); ok {
+				hostnames[name] = true
+			}
+		}
+	}
+
+	devices, _, err := client.DevicesApi.FindProjectDevices(context.TODO(), d.ProjectID).Execute()
+	if err != nil {
+		return nil, enrichApiError(err)
+	}
+
+	managed := []ManagedDevice{}
+	for _, device := range devices.GetDevices() {
+		if hostnames[device.GetHostname()] {
+			managed = append(managed, ManagedDevice{ID: device.GetId(), Hostname: device.GetHostname()})
+		}
+	}
+	return managed, nil
+}
+
+// DeviceEvent is a single entry from the device's event stream in a stable
+// shape for callers outside this package.
+type DeviceEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeviceEvents returns the device's recorded events (provisioning steps,
+// errors), newest first as the API reports them.
+func (d *Driver) DeviceEvents() ([]DeviceEvent, error) {
+	if d.DeviceID == "" {
+		return nil, fmt.Errorf("no device has been created for machine %q", d.MachineName)
+	}
+
+	events, _, err := d.getClient().EventsApi.FindDeviceEvents(context.TODO(), d.DeviceID).Execute()
+	if err != nil {
+		return nil, enrichApiError(err)
+	}
+
+	out := make([]DeviceEvent, 0, len(events.GetEvents()))
+	for _, event := range events.GetEvents() {
+		out = append(out, DeviceEvent{
+			ID:        event.GetId(),
+			Type:      event.GetType(),
+			Body:      event.GetInterpolated(),
+			CreatedAt: event.GetCreatedAt(),
+		})
+	}
+	return out, nil
+}
+
+// DeviceAge returns how long ago the device was created, using the timestamp
+// recorded at Create.  When the driver was restored from a machine store that
+// predates the field, created_at is fetched from the API once and cached.
+func (d *Driver) DeviceAge() (time.Duration, error) {
+	if d.CreatedAt.IsZero() {
+		if d.DeviceID == "" {
+			return 0, fmt.Errorf("no device has been created for machine %q", d.MachineName)
+		}
+		device, _, err := d.getClient().DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
 		if err != nil {
+			return 0, enrichApiError(err)
+		}
+		d.CreatedAt = device.GetCreatedAt()
+	}
+	return time.Since(d.CreatedAt), nil
+}
+
+// deviceSummary is the machine-readable record written after Create when
+// --metal-output-device-json is set.
+type deviceSummary struct {
+	ID              string   `json:"id"`
+	IPAddresses     []string `json:"ip_addresses"`
+	Plan            string   `json:"plan"`
+	Metro           string   `json:"metro,omitempty"`
+	Facility        string   `json:"facility,omitempty"`
+	OperatingSystem string   `json:"operating_system"`
+	BillingCycle    string   `json:"billing_cycle"`
+	Description     string   `json:"description,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+}
+
+func (d *Driver) writeDeviceSummary() error {
+	device, _, err := d.getClient().DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if err != nil {
+		return err
+	}
+
+	ips := []string{}
+	for _, ip := range device.GetIpAddresses() {
+		ips = append(ips, ip.GetAddress())
+	}
+
+	raw, err := json.MarshalIndent(deviceSummary{
+		ID:              d.DeviceID,
+		IPAddresses:     ips,
+		Plan:            d.Plan,
+		Metro:           d.Metro,
+		Facility:        d.Facility,
+		OperatingSystem: d.OperatingSystem,
+		BillingCycle:    d.BillingCycle,
+		Description:     d.Description,
+		Tags:            d.Tags,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	raw = append(raw, '\n')
+
+	if d.DeviceJsonOutput == "-" {
+		_, err = os.Stdout.Write(raw)
+		return err
+	}
+	return os.WriteFile(d.DeviceJsonOutput, raw, 0600)
+}
+
+// convertNetworkType converts the device's ports from the default Layer 3
+// mode to the configured network type via the Ports API.  Layer 2 modes
+// remove the device's IP assignments, so afterwards the device is re-checked
+// for a reachable address and a loud warning is logged when none remains.
+func (d *Driver) convertNetworkType(client *metal.APIClient) error {
+	log.Infof("Converting device network to %s...", d.NetworkType)
+
+	device, _, err := client.DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if err != nil {
+		return err
+	}
+	ports := map[string]string{}
+	for _, port := range device.GetNetworkPorts() {
+		ports[port.GetName()] = port.GetId()
+	}
+	bond, ok := ports["bond0"]
+	if !ok {
+		return fmt.Errorf("device %s has no bond0 port to convert", d.DeviceID)
+	}
+
+	switch d.NetworkType {
+	case networkTypeHybrid:
+		// keep the bond on Layer 3 and break out eth1 for Layer 2 use
+		eth1, ok := ports["eth1"]
+		if !ok {
+			return fmt.Errorf("device %s has no eth1 port for hybrid networking", d.DeviceID)
+		}
+		if _, _, err := client.PortsApi.DisbondPort(context.TODO(), eth1).BulkDisable(false).Execute(); err != nil {
+			return enrichApiError(err)
+		}
+	case networkTypeLayer2Bonded:
+		if _, _, err := client.PortsApi.ConvertLayer2(context.TODO(), bond).PortAssignInput(metal.PortAssignInput{}).Execute(); err != nil {
+			return enrichApiError(err)
+		}
+	case networkTypeLayer2Individual:
+		if _, _, err := client.PortsApi.ConvertLayer2(context.TODO(), bond).PortAssignInput(metal.PortAssignInput{}).Execute(); err != nil {
+			return enrichApiError(err)
+		}
+		if _, _, err := client.PortsApi.DisbondPort(context.TODO(), bond).BulkDisable(true).Execute(); err != nil {
+			return enrichApiError(err)
+		}
+	}
+
+	device, _, err = client.DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if err != nil {
+		return err
+	}
+	reachable := false
+	for _, ip := range device.GetIpAddresses() {
+		if ip.GetAddress() == d.IPAddress {
+			reachable = true
+		}
+	}
+	if !reachable {
+		log.Warnf("device %s no longer has its provisioning IP %s after the %s conversion, SSH access is likely broken", d.DeviceID, d.IPAddress, d.NetworkType)
+	}
+
+	return nil
+}
+
+// applyBondMode enforces the requested bonding mode on the device's bond0
+// port via the Ports API.  The API does not take a mode directly; it follows
+// from the bonding state, so 802.3ad bonds the port and balance-tlb breaks
+// the bond up.
+func (d *Driver) applyBondMode(client *metal.APIClient) error {
+	log.Infof("Configuring bond0 for %s...", d.BondMode)
+
+	device, _, err := client.DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if err != nil {
+		return err
+	}
+
+	for _, port := range device.GetNetworkPorts() {
+		if port.GetName() != "bond0" {
+			continue
+		}
+		data := port.GetData()
+		switch d.BondMode {
+		case bondMode8023ad:
+			if !data.GetBonded() {
+				if _, _, err := client.PortsApi.BondPort(context.TODO(), port.GetId()).BulkEnable(true).Execute(); err != nil {
+					return fmt.Errorf("bond0 could not be bonded for %s: %s", d.BondMode, enrichApiError(err))
+				}
+			}
+		case bondModeBalanceTlb:
+			if data.GetBonded() {
+				if _, _, err := client.PortsApi.DisbondPort(context.TODO(), port.GetId()).BulkDisable(false).Execute(); err != nil {
+					return fmt.Errorf("bond0 could not be disbonded for %s: %s", d.BondMode, enrichApiError(err))
+				}
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("device %s has no bond0 port to configure", d.DeviceID)
+}
+
+// validateGlobalIp checks that the configured reservation exists in the
+// project and really is a global anycast block; metro-scoped reservations
+// belong in --metal-ip-reservation-ids instead.
+func (d *Driver) validateGlobalIp(client *metal.APIClient) error {
+	reservations, _, err := client.IPAddressesApi.FindIPReservations(context.TODO(), d.ProjectID).Execute()
+	if err != nil {
+		return err
+	}
+
+	for _, inner := range reservations.IpAddresses {
+		reservation := inner.IPReservation
+		if reservation == nil || reservation.GetId() != d.GlobalIp {
+			continue
+		}
+		if reservation.Type != metal.IPRESERVATIONTYPE_GLOBAL_IPV4 {
+			return fmt.Errorf("IP reservation %s is type %s, not %s; use --%s for metro-scoped reservations", d.GlobalIp, reservation.Type, metal.IPRESERVATIONTYPE_GLOBAL_IPV4, argPrefix(argIpReservations))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no IP reservation %q in project %s", d.GlobalIp, d.ProjectID)
+}
+
+// validateVlan checks that the configured VLAN exists in the project and,
+// when it is metro-scoped, that it lives in the metro the device lands in.
+func (d *Driver) validateVlan(client *metal.APIClient) error {
+	vlans, _, err := client.VLANsApi.FindVirtualNetworks(context.TODO(), d.ProjectID).Execute()
+	if err != nil {
+		return err
+	}
+
+	for _, vlan := range vlans.VirtualNetworks {
+		if vlan.GetId() != d.Vlan && fmt.Sprint(vlan.GetVxlan()) != d.Vlan {
+			continue
+		}
+		if metro := vlan.GetMetroCode(); metro != "" && d.Metro != "" && metro != d.Metro {
+			return fmt.Errorf("VLAN %s is in metro %s, not the device metro %s", d.Vlan, metro, d.Metro)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no VLAN %q in project %s", d.Vlan, d.ProjectID)
+}
+
+// attachVlan assigns the device's Layer 2 port to the configured VLAN.  The
+// bond port carries the VLAN in layer2-bonded mode, eth1 in the other modes.
+func (d *Driver) attachVlan(client *metal.APIClient) error {
+	device, _, err := client.DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if err != nil {
+		return err
+	}
+
+	portName := "eth1"
+	if d.NetworkType == networkTypeLayer2Bonded {
+		portName = "bond0"
+	}
+	for _, port := range device.GetNetworkPorts() {
+		if port.GetName() != portName {
+			continue
+		}
+		log.Infof("Attaching port %s to VLAN %s...", portName, d.Vlan)
+		input := metal.PortAssignInput{Vnid: &d.Vlan}
+		if _, _, err := client.PortsApi.AssignPort(context.TODO(), port.GetId()).PortAssignInput(input).Execute(); err != nil {
+			return enrichApiError(err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("device %s has no %s port to attach to VLAN %s", d.DeviceID, portName, d.Vlan)
+}
+
+// enableBgp creates an IPv4 BGP session on the device.  The project must
+// already have BGP configured; when it does not and an MD5 password was
+// given, a local BGP deployment is requested with it first.
+func (d *Driver) enableBgp(client *metal.APIClient) error {
+	config, _, err := client.BGPApi.FindBgpConfigByProject(context.TODO(), d.ProjectID).Execute()
+	if err != nil {
+		return err
+	}
+
+	if config == nil || config.GetStatus() == metal.BGPCONFIGSTATUS_DISABLED || config.GetStatus() == "" {
+		if d.BgpMd5 == "" {
+			return fmt.Errorf("project %s does not have BGP configured, enable it in the console or pass --%s to request a local deployment", d.ProjectID, argPrefix(argBgpMd5))
+		}
+		log.Info("Requesting a local BGP deployment for the project...")
+		input := metal.BgpConfigRequestInput{
+			Asn:            65000,
+			DeploymentType: metal.BGPCONFIGREQUESTINPUTDEPLOYMENTTYPE_LOCAL,
+			Md5:            &d.BgpMd5,
+		}
+		if _, err := client.BGPApi.RequestBgpConfig(context.TODO(), d.ProjectID).BgpConfigRequestInput(input).Execute(); err != nil {
 			return err
 		}
+	}
+
+	log.Info("Enabling BGP on the device...")
+	family := metal.BGPSESSIONINPUTADDRESSFAMILY_IPV4
+	input := metal.BGPSessionInput{AddressFamily: &family}
+	session, _, err := client.DevicesApi.CreateBgpSession(context.TODO(), d.DeviceID).BGPSessionInput(input).Execute()
+	if err != nil {
+		return enrichApiError(err)
+	}
+	d.BgpSessionID = session.GetId()
+
+	return nil
+}
+
+// DeviceUsage is one line of a device's usage report, e.g. outbound
+// bandwidth in gigabytes, with the billed total for the queried window.
+type DeviceUsage struct {
+	Quantity string `json:"quantity"`
+	Total    string `json:"total"`
+	Unit     string `json:"unit"`
+}
+
+// Usage returns the device's usage records, including bandwidth, for the
+// given window, so external tooling can poll egress and catch runaway
+// traffic.  Plans without metering report no records, which is surfaced as
+// an explicit error rather than an empty slice.
+func (d *Driver) Usage(after, before time.Time) ([]DeviceUsage, error) {
+	usages, _, err := d.getClient().UsagesApi.FindDeviceUsages(context.TODO(), d.DeviceID).
+		CreatedAfter(after.UTC().Format(time.RFC3339)).
+		CreatedBefore(before.UTC().Format(time.RFC3339)).
+		Execute()
+	if err != nil {
+		return nil, enrichApiError(err)
+	}
+
+	if len(usages.Usages) == 0 {
+		return nil, fmt.Errorf("usage metrics are not available for device %s, the plan may not be metered", d.DeviceID)
+	}
+
+	report := make([]DeviceUsage, 0, len(usages.Usages))
+	for _, usage := range usages.Usages {
+		report = append(report, DeviceUsage{
+			Quantity: usage.GetQuantity(),
+			Total:    usage.GetTotal(),
+			Unit:     usage.GetUnit(),
+		})
+	}
+
+	return report, nil
+}
 
-		for _, ip := range newDevice.GetIpAddresses() {
-			if ip.GetPublic() && ip.GetAddressFamily() == 4 {
-				d.IPAddress = ip.GetAddress()
+// ConsoleAccess returns the device's Serial-over-SSH (SOS) hostname for
+// out-of-band console access, logging how to connect.  The SOS console uses
+// the project SSH keys, not the key docker-machine generated for the device.
+func (d *Driver) ConsoleAccess() (string, error) {
+	device, _, err := d.getClient().DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if err != nil {
+		return "", err
+	}
+
+	sos, ok := device.GetSosOk()
+	if !ok || *sos == "" {
+		plan := device.GetPlan()
+		return "", fmt.Errorf("out-of-band console access is not supported for plan %s", plan.GetSlug())
+	}
+
+	log.Infof("Serial-over-SSH console: ssh %s", *sos)
+	return *sos, nil
+}
+
+// UpdateTags sets tags on the created device, for lifecycle tooling that
+// labels machines after provisioning (e.g. to mark a maintenance window).
+// With merge set the given tags are unioned with the device's current tags,
+// otherwise they replace them.  The driver's Tags field is refreshed from the
+// API response.
+func (d *Driver) UpdateTags(tags []string, merge bool) error {
+	if merge {
+		merged := append([]string{}, d.Tags...)
+		for _, tag := range tags {
+			if !stringInSlice(tag, merged) {
+				merged = append(merged, tag)
 			}
 		}
+		tags = merged
+	}
 
-		if d.IPAddress != "" {
-			break
+	update := metal.DeviceUpdateInput{Tags: tags}
+	device, _, err := d.getClient().DevicesApi.UpdateDevice(context.TODO(), d.DeviceID).DeviceUpdateInput(update).Execute()
+	if err != nil {
+		return err
+	}
+	d.Tags = device.GetTags()
+
+	return nil
+}
+
+// userdataTemplateContext is the data available to --metal-userdata-template
+// templates.
+type userdataTemplateContext struct {
+	MachineName string
+	Metro       string
+	Plan        string
+	ProjectID   string
+}
+
+// renderUserdataTemplate renders the configured text/template file into the
+// userdata sent with the create request.  Parse and execution errors carry
+// the template file name and line from text/template.
+func (d *Driver) renderUserdataTemplate() (string, error) {
+	tmpl, err := template.ParseFiles(d.UserDataTemplate)
+	if err != nil {
+		return "", fmt.Errorf("user-data template could not be parsed: %s", err)
+	}
+
+	rendered := &strings.Builder{}
+	if err := tmpl.Execute(rendered, userdataTemplateContext{
+		MachineName: d.MachineName,
+		Metro:       d.Metro,
+		Plan:        d.Plan,
+		ProjectID:   d.ProjectID,
+	}); err != nil {
+		return "", fmt.Errorf("user-data template could not be rendered: %s", err)
+	}
+
+	return rendered.String(), nil
+}
+
+// resolveProjectID looks up the configured project name and stores the
+// matching project's ID, erroring when the name is missing or ambiguous.
+// When an organization ID is configured the lookup is restricted to that
+// organization's projects, which avoids ambiguity across organizations.
+func (d *Driver) resolveProjectID(client *metal.APIClient) error {
+	var projects *metal.ProjectList
+	var err error
+	if d.OrganizationID != "" {
+		projects, _, err = client.OrganizationsApi.FindOrganizationProjects(context.TODO(), d.OrganizationID).Name(d.ProjectName).Execute()
+	} else {
+		projects, _, err = client.ProjectsApi.FindProjects(context.TODO()).Name(d.ProjectName).Execute()
+	}
+	if err != nil {
+		return err
+	}
+
+	candidates := []string{}
+	matches := []metal.Project{}
+	for _, p := range projects.Projects {
+		candidates = append(candidates, p.GetName())
+		if p.GetName() == d.ProjectName {
+			matches = append(matches, p)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("no project named %q found, candidates: %v", d.ProjectName, candidates)
+	case 1:
+		d.ProjectID = matches[0].GetId()
+		return nil
+	}
+	return fmt.Errorf("project name %q is ambiguous, use --%s instead", d.ProjectName, argPrefix(argProjectID))
+}
+
+// nextAvailableHardwareReservation finds the first provisionable hardware
+// reservation in the project matching the configured plan.
+func (d *Driver) nextAvailableHardwareReservation(client *metal.APIClient) (string, error) {
+	reservations, _, err := client.HardwareReservationsApi.
+		FindProjectHardwareReservations(context.TODO(), d.ProjectID).
+		Provisionable(metal.FINDPROJECTHARDWARERESERVATIONSPROVISIONABLEPARAMETER_ONLY).
+		Execute()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range reservations.HardwareReservations {
+		if plan := r.GetPlan(); plan.GetSlug() == d.Plan {
+			return r.GetId(), nil
 		}
+	}
 
-		time.Sleep(1 * time.Second)
+	return "", fmt.Errorf("no provisionable hardware reservation for plan %s in project %s", d.Plan, d.ProjectID)
+}
+
+// waitForSSH blocks until SSH answers on the device.  With no configured
+// timeout it defers to the libmachine default; otherwise it retries the SSH
+// check until the deadline and reports the device IP and how long it waited.
+func (d *Driver) waitForSSH() error {
+	if d.SSHWaitTimeout <= 0 {
+		return drivers.WaitForSSH(d)
 	}
 
-	log.Infof("Created device ID %s, IP address %s",
-		newDevice.GetId(),
-		d.IPAddress)
+	deadline := time.Now().Add(d.SSHWaitTimeout)
+	for {
+		_, err := drivers.RunSSHCommandFromDriver(d, "exit 0")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("SSH on %s:%d did not answer within %s: %s", d.IPAddress, d.SSHPort, d.SSHWaitTimeout, err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
 
+// waitForProvisioning polls the device until it reaches the active state,
+// logging provisioning progress along the way.
+func (d *Driver) waitForProvisioning() error {
 	log.Info("Waiting for Provisioning...")
+	client := d.getClient()
 	stage := float32(0)
+	stageSince := time.Now()
+	seenEvents := map[string]bool{}
 	for {
-		newDevice, _, err = client.DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+		device, _, err := client.DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
 		if err != nil {
 			return err
 		}
-		if newDevice.GetState() == metal.DEVICESTATE_PROVISIONING && stage != newDevice.GetProvisioningPercentage() {
-			stage = newDevice.GetProvisioningPercentage()
-			log.Debugf("Provisioning %v%% complete", newDevice.GetProvisioningPercentage())
+		if d.TailEvents {
+			d.logNewEvents(seenEvents)
 		}
-		if newDevice.GetState() == metal.DEVICESTATE_ACTIVE {
-			log.Debugf("Device State: %s", newDevice.GetState())
-			break
+		if device.GetState() == metal.DEVICESTATE_PROVISIONING && stage != device.GetProvisioningPercentage() {
+			stage = device.GetProvisioningPercentage()
+			stageSince = time.Now()
+			d.debugLogf("Provisioning %v%% complete", device.GetProvisioningPercentage())
+		}
+		// a percentage that stops advancing usually means a hung install;
+		// give up early with a pointed diagnostic instead of waiting out
+		// the overall timeout
+		if d.ProvisionStall > 0 && device.GetState() == metal.DEVICESTATE_PROVISIONING && time.Since(stageSince) > d.ProvisionStall {
+			return fmt.Errorf("device %s has been stuck at %v%% provisioning for %s", d.DeviceID, stage, d.ProvisionStall)
+		}
+		if device.GetState() == metal.DEVICESTATE_ACTIVE {
+			log.Debugf("Device State: %s", device.GetState())
+			return nil
+		}
+		if device.GetState() == metal.DEVICESTATE_FAILED {
+			reason := ""
+			if events := device.GetProvisioningEvents(); len(events) > 0 {
+				reason = fmt.Sprintf(": %s", events[len(events)-1].GetInterpolated())
+			}
+			return fmt.Errorf("device %s failed to provision%s", d.DeviceID, reason)
 		}
 		time.Sleep(10 * time.Second)
 	}
+}
 
-	log.Debugf("Provision time: %v.", time.Since(t0))
+// logNewEvents logs device events that have not been seen yet in this wait,
+// oldest first so the log reads chronologically.  Event fetch failures are
+// only debug-logged; tailing must never fail the surrounding wait.
+func (d *Driver) logNewEvents(seen map[string]bool) {
+	events, err := d.DeviceEvents()
+	if err != nil {
+		d.debugLogf("device events could not be fetched: %s", err)
+		return
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if seen[event.ID] {
+			continue
+		}
+		seen[event.ID] = true
+		log.Infof("Event %s: %s", event.Type, event.Body)
+	}
+}
+
+// Reinstall reinstalls the operating system on the existing device, keeping
+// data on non-OS disks when preserveData is set, and waits for the device to
+// become active again.
+func (d *Driver) Reinstall(preserveData bool) error {
+	r := metal.DeviceActionInput{Type: metal.DEVICEACTIONINPUTTYPE_REINSTALL}
+	r.PreserveData = &preserveData
+	_, err := d.getClient().DevicesApi.PerformAction(context.TODO(), d.DeviceID).DeviceActionInput(r).Execute()
+	if err != nil {
+		return err
+	}
+
+	if err := d.waitForProvisioning(); err != nil {
+		return err
+	}
 
 	log.Debug("Waiting for SSH...")
-	if err := drivers.WaitForSSH(d); err != nil {
+	return d.waitForSSH()
+}
+
+// Rescue boots the device into the Equinix Metal rescue environment and
+// waits for it to come back up.  Note that the rescue environment uses its
+// own SSH credentials, not the key docker-machine generated for the device.
+func (d *Driver) Rescue() error {
+	r := metal.DeviceActionInput{Type: metal.DEVICEACTIONINPUTTYPE_RESCUE}
+	_, err := d.getClient().DevicesApi.PerformAction(context.TODO(), d.DeviceID).DeviceActionInput(r).Execute()
+	if err != nil {
 		return err
 	}
 
-	return nil
+	log.Info("Waiting for the rescue environment to boot...")
+	return d.waitForProvisioning()
 }
 
 func (d *Driver) createSSHKey() (*metal.SSHKey, error) {
 	sshKeyPath := d.GetSSHKeyPath()
 	log.Debugf("Writing SSH Key to %s", sshKeyPath)
 
-	if err := ssh.GenerateSSHKey(sshKeyPath); err != nil {
+	if d.ExistingSSHKey != "" {
+		// copy the user's key pair into the machine store so libmachine
+		// finds the private key at the usual path
+		for _, suffix := range []string{"", ".pub"} {
+			raw, err := os.ReadFile(d.ExistingSSHKey + suffix)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(sshKeyPath+suffix, raw, 0600); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := ssh.GenerateSSHKey(sshKeyPath); err != nil {
 		return nil, err
 	}
 
@@ -496,8 +2688,40 @@ func (d *Driver) createSSHKey() (*metal.SSHKey, error) {
 		return nil, err
 	}
 
+	if d.ReuseSSHKey {
+		fingerprint, err := publicKeyFingerprint(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		// the driver uploads user-scoped keys (POST /ssh-keys), which the
+		// project listing does not include, so check the current user's keys
+		// first to find our own earlier uploads, then the project's
+		userKeys, _, err := d.getClient().SSHKeysApi.FindSSHKeys(context.TODO()).Execute()
+		if err != nil {
+			return nil, enrichApiError(err)
+		}
+		projectKeys, _, err := d.getClient().SSHKeysApi.FindProjectSSHKeys(context.TODO(), d.ProjectID).Execute()
+		if err != nil {
+			return nil, enrichApiError(err)
+		}
+		for _, keys := range []*metal.SSHKeyList{userKeys, projectKeys} {
+			for i := range keys.SshKeys {
+				if keys.SshKeys[i].GetFingerprint() == fingerprint {
+					log.Infof("Reusing SSH key %s with fingerprint %s", keys.SshKeys[i].GetId(), fingerprint)
+					d.SSHKeyOwned = false
+					return &keys.SshKeys[i], nil
+				}
+			}
+		}
+	}
+
+	label, err := d.sshKeyLabel()
+	if err != nil {
+		return nil, err
+	}
+
 	createRequest := metal.SSHKeyCreateInput{}
-	createRequest.SetLabel(fmt.Sprintf("docker machine: %s", d.MachineName))
+	createRequest.SetLabel(label)
 	createRequest.SetKey(string(publicKey))
 	r := metal.ApiCreateSSHKeyRequest{}
 	r.SSHKeyCreateInput(createRequest)
@@ -507,9 +2731,68 @@ func (d *Driver) createSSHKey() (*metal.SSHKey, error) {
 		return key, err
 	}
 
+	d.SSHKeyOwned = true
 	return key, nil
 }
 
+// publicKeyFingerprint computes the MD5 fingerprint of an OpenSSH public key
+// in the colon-separated form the Equinix Metal API reports for SSH keys.
+func publicKeyFingerprint(publicKey []byte) (string, error) {
+	fields := strings.Fields(string(publicKey))
+	if len(fields) < 2 {
+		return "", fmt.Errorf("malformed OpenSSH public key")
+	}
+	raw, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed OpenSSH public key: %s", err)
+	}
+
+	sum := md5.Sum(raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// sshKeyLabel renders the label for the uploaded SSH key.  The template can
+// reference {{.MachineName}} and {{.Timestamp}} (RFC3339, UTC) so labels stay
+// unique across projects; without the flag the historical
+// "docker machine: <name>" format is kept.
+func (d *Driver) sshKeyLabel() (string, error) {
+	if d.SSHKeyLabel == "" {
+		return sshKeyLabelPrefix + d.MachineName, nil
+	}
+
+	tmpl, err := template.New("ssh-key-label").Parse(d.SSHKeyLabel)
+	if err != nil {
+		return "", fmt.Errorf("ssh-key label template could not be parsed: %s", err)
+	}
+
+	rendered := &strings.Builder{}
+	if err := tmpl.Execute(rendered, struct {
+		MachineName string
+		Timestamp   string
+	}{d.MachineName, time.Now().UTC().Format(time.RFC3339)}); err != nil {
+		return "", fmt.Errorf("ssh-key label template could not be rendered: %s", err)
+	}
+
+	return rendered.String(), nil
+}
+
+// GetSSHKeyContents returns the private key material generated by
+// createSSHKey, so tooling built on the driver (e.g. ansible wrappers) does
+// not have to know the store path layout.  It errors when no key has been
+// generated yet.
+func (d *Driver) GetSSHKeyContents() ([]byte, error) {
+	sshKeyPath := d.GetSSHKeyPath()
+	raw, err := os.ReadFile(sshKeyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no SSH key at %s, the key is generated during Create", sshKeyPath)
+	}
+	return raw, err
+}
+
 func (d *Driver) GetURL() (string, error) {
 	ip, err := d.GetIP()
 	if err != nil {
@@ -526,87 +2809,339 @@ func (d *Driver) GetIP() (string, error) {
 }
 
 func (d *Driver) GetState() (state.State, error) {
-	device, _, err := d.getClient().DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if d.StateCacheTTL > 0 && d.cachedStateFor == d.DeviceID && time.Since(d.cachedStateAt) < d.StateCacheTTL {
+		return d.cachedState, nil
+	}
+
+	device, resp, err := d.getClient().DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
 	if err != nil {
+		if isNotFound(resp) {
+			// deleted out-of-band, e.g. in the portal or by a spot
+			// reclamation; report the machine as gone instead of erroring
+			// `docker-machine ls`
+			return d.reclaimedSpotState(state.None), nil
+		}
 		return state.Error, err
 	}
 
-	switch device.GetState() {
-	case metal.DEVICESTATE_QUEUED, metal.DEVICESTATE_PROVISIONING, metal.DEVICESTATE_POWERING_ON:
-		return state.Starting, nil
+	current := deviceState(device.GetState())
+	d.cachedState = current
+	d.cachedStateAt = time.Now()
+	d.cachedStateFor = d.DeviceID
+
+	return current, nil
+}
+
+// reclaimedSpotState adjusts how a spot device that no longer exists is
+// reported, according to --metal-spot-termination-action.  It only applies
+// to the missing-device path: a device the API still knows about reports
+// its real power state, so a deliberate stop is never mistaken for a
+// reclamation.
+func (d *Driver) reclaimedSpotState(observed state.State) state.State {
+	if !d.SpotInstance || observed != state.None {
+		return observed
+	}
+	if d.SpotTermAction == spotTerminationStopped {
+		return state.Stopped
+	}
+	return observed
+}
+
+// invalidateStateCache drops the memoized GetState result after actions that
+// change the device's power state.
+func (d *Driver) invalidateStateCache() {
+	d.cachedStateFor = ""
+}
+
+func deviceState(deviceState metal.DeviceState) state.State {
+	switch deviceState {
+	case metal.DEVICESTATE_QUEUED, metal.DEVICESTATE_PROVISIONING, metal.DEVICESTATE_REINSTALLING, metal.DEVICESTATE_POWERING_ON:
+		return state.Starting
 	case metal.DEVICESTATE_ACTIVE:
-		return state.Running, nil
-	case metal.DEVICESTATE_POWERING_OFF:
-		return state.Stopping, nil
+		return state.Running
+	case metal.DEVICESTATE_POWERING_OFF, metal.DEVICESTATE_DEPROVISIONING:
+		return state.Stopping
 	case metal.DEVICESTATE_INACTIVE:
-		return state.Stopped, nil
+		return state.Stopped
+	case metal.DEVICESTATE_FAILED:
+		return state.Error
+	}
+	return state.None
+}
+
+// rawState reports the device state as the API returns it, without the
+// --metal-spot-termination-action adjustment and without the GetState
+// cache; a missing device is state.None.
+func (d *Driver) rawState() (state.State, error) {
+	device, resp, err := d.getClient().DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute()
+	if err != nil {
+		if isNotFound(resp) {
+			return state.None, nil
+		}
+		return state.Error, err
+	}
+	return deviceState(device.GetState()), nil
+}
+
+// waitForPowerState polls until the device reaches the target state or the
+// configured power timeout elapses.  It compares the raw device state so
+// --metal-spot-termination-action reporting cannot mask the power
+// transition being waited on.
+func (d *Driver) waitForPowerState(target state.State) error {
+	timeout := d.PowerTimeout
+	if timeout <= 0 {
+		timeout = defaultPowerTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := d.rawState()
+		if err != nil {
+			return err
+		}
+		if current == target {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting %s for device %s to reach the %s state", timeout, d.DeviceID, target)
+		}
+		time.Sleep(5 * time.Second)
 	}
-	return state.None, nil
 }
 
 func (d *Driver) Start() error {
+	d.invalidateStateCache()
 	r := metal.DeviceActionInput{Type: metal.DEVICEACTIONINPUTTYPE_POWER_ON}
-	_, err := d.getClient().DevicesApi.PerformAction(context.TODO(), d.DeviceID).DeviceActionInput(r).Execute()
-	return err
+	if resp, err := d.getClient().DevicesApi.PerformAction(context.TODO(), d.DeviceID).DeviceActionInput(r).Execute(); err != nil {
+		if isNotFound(resp) {
+			return fmt.Errorf("device %s no longer exists, it was deleted outside of docker-machine", d.DeviceID)
+		}
+		return err
+	}
+	return d.waitForPowerState(state.Running)
 }
 
 func (d *Driver) Stop() error {
+	d.invalidateStateCache()
 	r := metal.DeviceActionInput{Type: metal.DEVICEACTIONINPUTTYPE_POWER_OFF}
-	_, err := d.getClient().DevicesApi.PerformAction(context.TODO(), d.DeviceID).DeviceActionInput(r).Execute()
-	return err
+	if resp, err := d.getClient().DevicesApi.PerformAction(context.TODO(), d.DeviceID).DeviceActionInput(r).Execute(); err != nil {
+		if isNotFound(resp) {
+			return fmt.Errorf("device %s no longer exists, it was deleted outside of docker-machine", d.DeviceID)
+		}
+		return err
+	}
+	return d.waitForPowerState(state.Stopped)
 }
 
-func ignoreStatusCodes(resp *http.Response, err error, codes ...int) error {
-	if err == nil && resp == nil {
-		return nil
+// enrichApiError appends the structured messages from a metalv1 error
+// response body to the SDK error, which is otherwise often just "400 Bad
+// Request".  Errors without a parseable body pass through unchanged.
+func enrichApiError(err error) error {
+	var apiErr *metal.GenericOpenAPIError
+	if !errors.As(err, &apiErr) {
+		return err
 	}
-	if err != nil {
+
+	body := metal.Error{}
+	if jsonErr := json.Unmarshal(apiErr.Body(), &body); jsonErr != nil {
+		return err
+	}
+	messages := body.Errors
+	if body.Error != nil {
+		messages = append(messages, *body.Error)
+	}
+	if len(messages) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("%s: %s", err, strings.Join(messages, "; "))
+}
+
+// isCapacityError reports whether a create failure was the API declining the
+// request for lack of plan capacity, which is worth retrying, as opposed to a
+// bad request that will never succeed.
+func isCapacityError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "capacity")
+}
+
+// isNotFound reports whether an API response said the resource is gone,
+// which for devices usually means an out-of-band deletion.
+func isNotFound(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode == http.StatusNotFound
+}
+
+// ignoreStatusCodes swallows API errors whose HTTP status is one of codes.
+// A nil error paired with a non-2xx response is still reported, so a
+// transport that hands back a failure response without an error cannot
+// silently pass for success.
+func ignoreStatusCodes(resp *http.Response, err error, codes ...int) error {
+	if resp != nil {
 		for _, c := range codes {
 			if resp.StatusCode == c {
 				return nil
 			}
 		}
 	}
+	if err == nil && resp != nil && (resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices) {
+		return fmt.Errorf("unexpected API response status %s", resp.Status)
+	}
 
 	return err
 }
 
 func (d *Driver) Remove() error {
+	d.invalidateStateCache()
 	client := d.getClient()
-	if resp, err := client.SSHKeysApi.DeleteSSHKey(context.TODO(), d.SSHKeyID).Execute(); ignoreStatusCodes(resp, err, http.StatusForbidden, http.StatusNotFound) != nil {
+
+	reservationID := ""
+	if device, resp, err := client.DevicesApi.FindDeviceById(context.TODO(), d.DeviceID).Execute(); err == nil {
+		if device.GetLocked() {
+			return fmt.Errorf("device %s is locked, unlock it before removing", d.DeviceID)
+		}
+		reservation := device.GetHardwareReservation()
+		reservationID = reservation.GetId()
+	} else if resp != nil && resp.StatusCode != http.StatusNotFound {
 		return err
 	}
 
-	resp, err := client.DevicesApi.DeleteDevice(context.TODO(), d.DeviceID).Execute()
-	return ignoreStatusCodes(resp, err, http.StatusForbidden, http.StatusNotFound)
+	// with --metal-keep-reservation a device on reserved hardware stays
+	// provisioned (and its SSH key in place), so the reservation remains
+	// bound instead of being released back to the project
+	if d.KeepReservation && reservationID != "" {
+		log.Infof("Keeping device %s provisioned on hardware reservation %s; deprovision it manually to release the reservation", d.DeviceID, reservationID)
+		return nil
+	}
+
+	if d.SSHKeyOwned {
+		resp, keyErr := client.SSHKeysApi.DeleteSSHKey(context.TODO(), d.SSHKeyID).Execute()
+		if keyErr := ignoreStatusCodes(resp, keyErr, http.StatusForbidden, http.StatusNotFound); keyErr != nil {
+			return keyErr
+		}
+	}
+
+	if reservationID != "" {
+		log.Infof("Releasing hardware reservation %s back to the project", reservationID)
+	}
+
+	// a device that is still provisioning is not deletable yet and the API
+	// answers 422/409; keep retrying within a bounded window rather than
+	// leaving an orphaned, still-billing device behind
+	deadline := time.Now().Add(removeRetryTimeout)
+	for {
+		resp, err := client.DevicesApi.DeleteDevice(context.TODO(), d.DeviceID).Execute()
+		// A forbidden delete must not be ignored: the device still exists
+		// (and bills), typically because it is locked.
+		if resp != nil && resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("device %s could not be deleted and still exists, it may be locked: %s", d.DeviceID, err)
+		}
+		if resp != nil && (resp.StatusCode == http.StatusUnprocessableEntity || resp.StatusCode == http.StatusConflict) && time.Now().Add(removeRetryInterval).Before(deadline) {
+			log.Infof("device %s is not deletable in its current state, retrying in %s", d.DeviceID, removeRetryInterval)
+			time.Sleep(removeRetryInterval)
+			continue
+		}
+		return ignoreStatusCodes(resp, enrichApiError(err), http.StatusNotFound)
+	}
 }
 
 func (d *Driver) Restart() error {
+	d.invalidateStateCache()
 	r := metal.DeviceActionInput{Type: metal.DEVICEACTIONINPUTTYPE_REBOOT}
-	_, err := d.getClient().DevicesApi.PerformAction(context.TODO(), d.DeviceID).DeviceActionInput(r).Execute()
-	return err
+	resp, err := d.getClient().DevicesApi.PerformAction(context.TODO(), d.DeviceID).DeviceActionInput(r).Execute()
+	if err != nil {
+		if isNotFound(resp) {
+			return fmt.Errorf("device %s no longer exists, it was deleted outside of docker-machine", d.DeviceID)
+		}
+		return err
+	}
+
+	if d.WaitOnRestart {
+		if err := d.waitForPowerState(state.Running); err != nil {
+			return err
+		}
+		log.Debug("Waiting for SSH...")
+		return d.waitForSSH()
+	}
+
+	return nil
 }
 
+// Kill powers the device off immediately.  Unlike Stop it does not wait for
+// the device to reach the stopped state, matching docker-machine's forceful
+// kill semantics.
 func (d *Driver) Kill() error {
-	return d.Stop()
+	d.invalidateStateCache()
+	r := metal.DeviceActionInput{Type: metal.DEVICEACTIONINPUTTYPE_POWER_OFF}
+	_, err := d.getClient().DevicesApi.PerformAction(context.TODO(), d.DeviceID).DeviceActionInput(r).Execute()
+	return err
 }
 
 func (d *Driver) GetDockerConfigDir() string {
 	return dockerConfigDir
 }
 
+// getClient builds the configured production API client, unless a test has
+// injected its own through clientFactory.
 func (d *Driver) getClient() *metal.APIClient {
+	if d.clientFactory != nil {
+		return d.clientFactory()
+	}
 	config := metal.NewConfiguration()
-	config.AddDefaultHeader("X-Consumer-Token", consumerToken)
+	if d.ApiUrl != "" {
+		config.Servers = metal.ServerConfigurations{{URL: d.ApiUrl}}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if d.HttpsProxy != "" {
+		// validated in SetConfigFromFlags
+		proxyUrl, _ := url.Parse(d.HttpsProxy)
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	var roundTripper http.RoundTripper = transport
+	if d.Debug {
+		roundTripper = &debugRoundTripper{base: roundTripper}
+	}
+	if d.MaxRps > 0 {
+		roundTripper = &rateLimitRoundTripper{base: roundTripper, limiter: limiterForToken(d.ApiKey, d.MaxRps)}
+	}
+	if d.ApiRetries > 0 {
+		roundTripper = &retryRoundTripper{base: roundTripper, maxRetries: d.ApiRetries}
+	}
+	apiTimeout := d.ApiTimeout
+	if apiTimeout <= 0 {
+		apiTimeout = defaultApiTimeout
+	}
+	config.HTTPClient = &http.Client{Transport: roundTripper, Timeout: apiTimeout}
+	if !d.NoConsumerToken {
+		token := consumerToken
+		if d.ConsumerToken != "" {
+			token = d.ConsumerToken
+		}
+		config.AddDefaultHeader("X-Consumer-Token", token)
+	}
 	config.AddDefaultHeader("X-Auth-Token", d.ApiKey)
-	userAgent := fmt.Sprintf("docker-machine-driver-%s/%s %s", d.DriverName(), version, config.UserAgent)
+	config.UserAgent = d.userAgent(config.UserAgent)
+	client := metal.NewAPIClient(config)
+
+	return client
+}
+
+// userAgent assembles the User-Agent header as "prefix driver/version
+// sdk-agent suffix", keeping the driver's own identification in the middle
+// so both wrapping products and called-from products can tag requests.
+func (d *Driver) userAgent(sdkUserAgent string) string {
+	userAgent := fmt.Sprintf("docker-machine-driver-%s/%s %s", d.DriverName(), version, sdkUserAgent)
 	if len(d.UserAgentPrefix) > 0 {
 		userAgent = fmt.Sprintf("%s %s", d.UserAgentPrefix, userAgent)
 	}
-	config.UserAgent = userAgent
-	client := metal.NewAPIClient(config)
+	if len(d.UserAgentSuffix) > 0 {
+		userAgent = fmt.Sprintf("%s %s", userAgent, d.UserAgentSuffix)
+	}
+	return userAgent
+}
 
-	return client
+// Version reports the driver build version stamped by goreleaser, "devel"
+// for builds without one. It is the same value the User-Agent header
+// carries, exposed for tools that embed the driver and want to log it.
+func Version() string {
+	return version
 }
 
 func (d *Driver) getOsFlavors() ([]string, error) {
@@ -615,15 +3150,26 @@ func (d *Driver) getOsFlavors() ([]string, error) {
 		return nil, err
 	}
 
+	flavors := make([]string, 0, len(operatingSystems.OperatingSystems))
+	if d.AllowAnyOS {
+		log.Warnf("--%s bypasses the curated distro list, the chosen OS may not work with docker-machine provisioning", argPrefix(argAllowAnyOS))
+		for _, flavor := range operatingSystems.OperatingSystems {
+			flavors = append(flavors, flavor.GetSlug())
+		}
+		return flavors, nil
+	}
+
 	supportedDistros := []string{
+		"alma",
 		"centos",
 		"coreos",
 		"debian",
+		"flatcar",
 		"opensuse",
 		"rancher",
+		"rocky",
 		"ubuntu",
 	}
-	flavors := make([]string, 0, len(operatingSystems.OperatingSystems))
 	for _, flavor := range operatingSystems.OperatingSystems {
 		if stringInSlice(flavor.GetDistro(), supportedDistros) {
 			flavors = append(flavors, flavor.GetSlug())
@@ -632,8 +3178,27 @@ func (d *Driver) getOsFlavors() ([]string, error) {
 	return flavors, nil
 }
 
+// validateFacility accepts a single facility code or a comma-separated list
+// of codes the scheduler may fall back through in order.
+// facilityRefinesMetro reports whether every facility in the comma-separated
+// list exists and sits in the given metro, in which case the facility is a
+// narrower way of saying the same location.
+func facilityRefinesMetro(facilities []metal.Facility, facility, metro string) bool {
+	metroByCode := map[string]string{}
+	for _, f := range facilities {
+		m := f.GetMetro()
+		metroByCode[f.GetCode()] = m.GetCode()
+	}
+	for _, code := range strings.Split(facility, ",") {
+		if metroByCode[code] != metro {
+			return false
+		}
+	}
+	return true
+}
+
 func validateFacility(client *metal.APIClient, facility string) error {
-	if facility == "any" {
+	if facility == anyLocation {
 		return nil
 	}
 
@@ -641,16 +3206,46 @@ func validateFacility(client *metal.APIClient, facility string) error {
 	if err != nil {
 		return err
 	}
+	codes := map[string]bool{}
 	for _, f := range facilities.Facilities {
-		if f.GetCode() == facility {
+		codes[f.GetCode()] = true
+	}
+	for _, code := range strings.Split(facility, ",") {
+		if !codes[code] {
+			return fmt.Errorf("%s requires a valid facility, %q is not one", driverName, code)
+		}
+	}
+
+	return nil
+}
+
+// pickMetroWithCapacity resolves the "any" metro wildcard by choosing the
+// first metro reporting capacity for the configured plan.  The API has no
+// native any-metro scheduling, so the driver settles the choice up front.
+func (d *Driver) pickMetroWithCapacity(client *metal.APIClient) error {
+	metros, _, err := client.MetrosApi.FindMetros(context.TODO()).Execute()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range metros.Metros {
+		if err := validateCapacity(client, d.Plan, m.GetCode()); err == nil {
+			log.Infof("Metro %q selected for plan %s", m.GetCode(), d.Plan)
+			d.Metro = m.GetCode()
 			return nil
 		}
 	}
 
-	return fmt.Errorf("%s requires a valid facility", driverName)
+	return fmt.Errorf("no metro has capacity for plan %s", d.Plan)
 }
 
+// validateMetro accepts any known metro code, or the "any" wildcard which
+// is resolved to a concrete metro before the device is created.
 func validateMetro(client *metal.APIClient, metro string) error {
+	if metro == anyLocation {
+		return nil
+	}
+
 	metros, _, err := client.MetrosApi.FindMetros(context.TODO()).Execute()
 	if err != nil {
 		return err
@@ -664,6 +3259,100 @@ func validateMetro(client *metal.APIClient, metro string) error {
 	return fmt.Errorf("%s requires a valid metro", driverName)
 }
 
+// SpotMarketPrice returns the current spot market price for the configured
+// plan in the configured metro, or zero when the API does not report one.
+func (d *Driver) SpotMarketPrice(client *metal.APIClient) (float32, error) {
+	prices, _, err := client.SpotMarketApi.FindMetroSpotMarketPrices(context.TODO()).Metro(d.Metro).Plan(d.Plan).Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	// The report is keyed by metro then plan; round-trip through JSON
+	// rather than switching on the SDK's per-metro struct fields.
+	raw, err := json.Marshal(prices.GetSpotMarketPrices())
+	if err != nil {
+		return 0, err
+	}
+	report := map[string]map[string]struct {
+		Price float32 `json:"price"`
+	}{}
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return 0, err
+	}
+
+	return report[d.Metro][d.Plan].Price, nil
+}
+
+// checkSpotMarketPrice logs the current spot market price and rejects spot
+// bids that could never be fulfilled at the configured maximum.
+func (d *Driver) checkSpotMarketPrice(client *metal.APIClient) error {
+	price, err := d.SpotMarketPrice(client)
+	if err != nil {
+		return err
+	}
+	if price == 0 {
+		log.Debugf("No spot market price reported for plan %s in metro %s", d.Plan, d.Metro)
+		return nil
+	}
+
+	log.Infof("Current spot market price for plan %s in metro %s: %v", d.Plan, d.Metro, price)
+	if d.SpotPriceMax > 0 && d.SpotPriceMax < price {
+		return fmt.Errorf("--%s %v is below the current market price %v for plan %s in metro %s", argPrefix(argSpotPriceMax), d.SpotPriceMax, price, d.Plan, d.Metro)
+	}
+
+	return nil
+}
+
+func validatePlan(client *metal.APIClient, plan string) error {
+	plans, _, err := client.PlansApi.FindPlans(context.TODO()).Execute()
+	if err != nil {
+		return err
+	}
+
+	slugs := []string{}
+	for _, p := range plans.Plans {
+		if p.GetSlug() == plan {
+			return nil
+		}
+		slugs = append(slugs, p.GetSlug())
+	}
+
+	// narrow the suggestion list to slugs sharing the plan family, e.g.
+	// "c3" for a mistyped "c3.small.x64"
+	family := strings.SplitN(plan, ".", 2)[0]
+	close := []string{}
+	for _, slug := range slugs {
+		if strings.HasPrefix(slug, family) {
+			close = append(close, slug)
+		}
+	}
+	if len(close) == 0 {
+		close = slugs
+	}
+
+	return fmt.Errorf("%s requires a valid plan, %q is not one (did you mean one of %s?)", driverName, plan, strings.Join(close, ", "))
+}
+
+func validateCapacity(client *metal.APIClient, plan, metro string) error {
+	quantity := "1"
+	input := metal.CapacityInput{
+		Servers: []metal.ServerInfo{
+			{Plan: &plan, Metro: &metro, Quantity: &quantity},
+		},
+	}
+	capacity, _, err := client.CapacityApi.CheckCapacityForMetro(context.TODO()).CapacityInput(input).Execute()
+	if err != nil {
+		return err
+	}
+	for _, s := range capacity.Servers {
+		if !s.GetAvailable() {
+			return fmt.Errorf("plan %s is not available in metro %s", plan, metro)
+		}
+	}
+
+	return nil
+}
+
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -1,10 +1,18 @@
 package metal
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/state"
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,3 +33,365 @@ func TestSetConfigFromFlags(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Empty(t, checkFlags.InvalidFlags)
 }
+
+func TestSetConfigFromFlagsFlatcarSSHUser(t *testing.T) {
+	driver := NewDriver("", "")
+	configPath := os.Getenv("METAL_CONFIG")
+	os.Setenv("METAL_CONFIG", "/does-not-exist")
+	checkFlags := &drivers.CheckDriverOptions{
+		FlagsValues: map[string]interface{}{
+			"metal-api-key":    "APIKEY",
+			"metal-project-id": "PROJECT",
+			"metal-os":         "flatcar_stable",
+		},
+		CreateFlags: driver.GetCreateFlags(),
+	}
+
+	err := driver.SetConfigFromFlags(checkFlags)
+	os.Setenv("METAL_CONFIG", configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "core", driver.SSHUser)
+}
+
+func TestSetConfigFromFlagsSpotWithHardwareReservation(t *testing.T) {
+	driver := NewDriver("", "")
+	configPath := os.Getenv("METAL_CONFIG")
+	os.Setenv("METAL_CONFIG", "/does-not-exist")
+	checkFlags := &drivers.CheckDriverOptions{
+		FlagsValues: map[string]interface{}{
+			"metal-api-key":           "APIKEY",
+			"metal-project-id":        "PROJECT",
+			"metal-spot-instance":     true,
+			"metal-spot-price-max":    "0.5",
+			"metal-hw-reservation-id": "RESERVATION",
+		},
+		CreateFlags: driver.GetCreateFlags(),
+	}
+
+	err := driver.SetConfigFromFlags(checkFlags)
+	os.Setenv("METAL_CONFIG", configPath)
+	assert.ErrorContains(t, err, "mutually exclusive")
+}
+
+func TestResolveOperatingSystemPrecedence(t *testing.T) {
+	assert.Equal(t, "debian_12", resolveOperatingSystem("debian_12", "rocky_9"))
+	assert.Equal(t, "rocky_9", resolveOperatingSystem("", "rocky_9"))
+	assert.Equal(t, defaultOS, resolveOperatingSystem("", ""))
+}
+
+func TestValidateMetroAnySkipsValidation(t *testing.T) {
+	// "any" must pass through without an API round-trip; a nil client would
+	// panic if validateMetro tried to call out
+	assert.NoError(t, validateMetro(nil, "any"))
+}
+
+func TestResolveMetroPrecedence(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		flag     string
+		config   string
+		facility string
+		want     string
+	}{
+		{name: "flag wins over config", flag: "sv", config: "ny", want: "sv"},
+		{name: "flag wins with facility set", flag: "sv", facility: "dc13", want: "sv"},
+		{name: "config when no flag", config: "ny", want: "ny"},
+		{name: "default when nothing set", want: defaultMetro},
+		{name: "no default when facility set", facility: "dc13", want: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, resolveMetro(tt.flag, tt.config, tt.facility))
+		})
+	}
+}
+
+func TestMetroForRegion(t *testing.T) {
+	assert.Equal(t, "ny", metroForRegion("us-east-1"))
+	assert.Equal(t, "fr", metroForRegion("EU-CENTRAL-1"))
+	// values without an alias pass through for validateMetro to judge
+	assert.Equal(t, "da", metroForRegion("da"))
+}
+
+func TestSetConfigFromFlagsRegionAlias(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		flags map[string]interface{}
+		want  string
+	}{
+		{name: "region alias resolves to a metro", flags: map[string]interface{}{"metal-region": "us-west-2"}, want: "se"},
+		{name: "metro-code wins over region", flags: map[string]interface{}{"metal-region": "us-west-2", "metal-metro-code": "da"}, want: "da"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := NewDriver("", "")
+			configPath := os.Getenv("METAL_CONFIG")
+			os.Setenv("METAL_CONFIG", "/does-not-exist")
+			flagsValues := map[string]interface{}{
+				"metal-api-key":    "APIKEY",
+				"metal-project-id": "PROJECT",
+			}
+			for k, v := range tt.flags {
+				flagsValues[k] = v
+			}
+			checkFlags := &drivers.CheckDriverOptions{
+				FlagsValues: flagsValues,
+				CreateFlags: driver.GetCreateFlags(),
+			}
+
+			err := driver.SetConfigFromFlags(checkFlags)
+			os.Setenv("METAL_CONFIG", configPath)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, driver.Metro)
+		})
+	}
+}
+
+func TestFacilityRefinesMetro(t *testing.T) {
+	facility := func(code, metro string) metal.Facility {
+		m := metal.DeviceMetro{Code: &metro}
+		return metal.Facility{Code: &code, Metro: &m}
+	}
+	facilities := []metal.Facility{
+		facility("dc13", "dc"),
+		facility("ny5", "ny"),
+		facility("ny7", "ny"),
+	}
+
+	assert.True(t, facilityRefinesMetro(facilities, "dc13", "dc"))
+	assert.True(t, facilityRefinesMetro(facilities, "ny5,ny7", "ny"))
+	assert.False(t, facilityRefinesMetro(facilities, "dc13", "ny"))
+	assert.False(t, facilityRefinesMetro(facilities, "dc13,ny5", "dc"))
+	assert.False(t, facilityRefinesMetro(facilities, "unknown", "dc"))
+}
+
+func TestParseTerminationTime(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	parsed, err := parseTerminationTime("+90m", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(90*time.Minute), *parsed)
+
+	parsed, err = parseTerminationTime("2024-05-01T15:00:00+02:00", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC), *parsed)
+	assert.Equal(t, time.UTC, parsed.Location())
+
+	_, err = parseTerminationTime("2020-01-01T00:00:00Z", now)
+	assert.ErrorContains(t, err, "not in the future")
+
+	_, err = parseTerminationTime("+bogus", now)
+	assert.ErrorContains(t, err, "RFC3339")
+
+	parsed, err = parseTerminationTime("", now)
+	assert.NoError(t, err)
+	assert.Nil(t, parsed)
+}
+
+func TestListManagedDevices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/projects/PROJECT/ssh-keys"):
+			// the driver's own uploads are user-scoped and never show up here
+			_, _ = w.Write([]byte(`{"ssh_keys": [
+				{"id": "KEY2", "label": "laptop"}
+			]}`))
+		case strings.HasSuffix(r.URL.Path, "/ssh-keys"):
+			_, _ = w.Write([]byte(`{"ssh_keys": [
+				{"id": "KEY1", "label": "docker machine: worker-0"}
+			]}`))
+		case strings.HasSuffix(r.URL.Path, "/devices"):
+			_, _ = w.Write([]byte(`{"devices": [
+				{"id": "DEV1", "hostname": "worker-0"},
+				{"id": "DEV2", "hostname": "pet"}
+			]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	driver := NewDriver("", "")
+	driver.ProjectID = "PROJECT"
+	driver.ApiUrl = server.URL
+
+	managed, err := driver.ListManagedDevices()
+	assert.NoError(t, err)
+	assert.Equal(t, []ManagedDevice{{ID: "DEV1", Hostname: "worker-0"}}, managed)
+}
+
+func TestSelectIPAddressDeterministic(t *testing.T) {
+	ip := func(addr string, management, global bool) metal.IPAssignment {
+		family := int32(4)
+		public := true
+		return metal.IPAssignment{
+			Address:       &addr,
+			AddressFamily: &family,
+			Public:        &public,
+			Management:    &management,
+			GlobalIp:      &global,
+		}
+	}
+	driver := NewDriver("", "")
+
+	// the management address wins regardless of listing order
+	management := ip("192.0.2.1", true, false)
+	extra := ip("198.51.100.7", false, false)
+	assert.Equal(t, "192.0.2.1", driver.selectIPAddress([]metal.IPAssignment{extra, management}))
+	assert.Equal(t, "192.0.2.1", driver.selectIPAddress([]metal.IPAssignment{management, extra}))
+
+	// without a management address the first listed match is used
+	assert.Equal(t, "198.51.100.7", driver.selectIPAddress([]metal.IPAssignment{extra, ip("198.51.100.8", false, false)}))
+
+	// a requested anycast address beats even the management one
+	driver.GlobalIp = "RESERVATION"
+	assert.Equal(t, "203.0.113.5", driver.selectIPAddress([]metal.IPAssignment{management, ip("203.0.113.5", false, true)}))
+}
+
+func TestReclaimedSpotStateMapping(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		spot     bool
+		action   string
+		observed state.State
+		want     state.State
+	}{
+		{name: "on-demand devices are untouched", spot: false, action: spotTerminationStopped, observed: state.None, want: state.None},
+		{name: "no action keeps the observed state", spot: true, observed: state.None, want: state.None},
+		{name: "stopped maps a vanished device to powered off", spot: true, action: spotTerminationStopped, observed: state.None, want: state.Stopped},
+		{name: "stopped keeps a running device running", spot: true, action: spotTerminationStopped, observed: state.Running, want: state.Running},
+		{name: "none reports a vanished device as gone", spot: true, action: spotTerminationNone, observed: state.None, want: state.None},
+		{name: "a deliberately stopped device stays stopped", spot: true, action: spotTerminationNone, observed: state.Stopped, want: state.Stopped},
+		{name: "stopped action does not touch a stopped device", spot: true, action: spotTerminationStopped, observed: state.Stopped, want: state.Stopped},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := NewDriver("", "")
+			driver.SpotInstance = tt.spot
+			driver.SpotTermAction = tt.action
+			assert.Equal(t, tt.want, driver.reclaimedSpotState(tt.observed))
+		})
+	}
+}
+
+func TestGetStateCachesWithinTTL(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id": "DEVICE", "state": "active"}`))
+	}))
+	defer server.Close()
+
+	driver := NewDriver("", "")
+	driver.DeviceID = "DEVICE"
+	driver.ApiUrl = server.URL
+	driver.StateCacheTTL = time.Minute
+
+	for i := 0; i < 2; i++ {
+		got, err := driver.GetState()
+		assert.NoError(t, err)
+		assert.Equal(t, state.Running, got)
+	}
+	assert.Equal(t, 1, requests)
+
+	driver.invalidateStateCache()
+	_, err := driver.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+}
+
+func TestIgnoreStatusCodes(t *testing.T) {
+	apiErr := errors.New("API error")
+	resp := func(code int) *http.Response {
+		return &http.Response{StatusCode: code, Status: http.StatusText(code)}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		resp    *http.Response
+		err     error
+		codes   []int
+		wantErr bool
+	}{
+		{name: "matching code is ignored", resp: resp(404), err: apiErr, codes: []int{403, 404}},
+		{name: "non-matching code passes through", resp: resp(422), err: apiErr, codes: []int{404}, wantErr: true},
+		{name: "success without error", resp: resp(200), err: nil, codes: []int{404}},
+		{name: "failure status without error is reported", resp: resp(422), err: nil, codes: []int{404}, wantErr: true},
+		{name: "ignored status without error", resp: resp(404), err: nil, codes: []int{404}},
+		{name: "transport error without response", resp: nil, err: apiErr, codes: []int{404}, wantErr: true},
+		{name: "nothing at all", resp: nil, err: nil, codes: []int{404}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ignoreStatusCodes(tt.resp, tt.err, tt.codes...)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestClientFactoryInjection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id": "DEVICE", "state": "active"}`))
+	}))
+	defer server.Close()
+
+	driver := NewDriver("", "")
+	driver.DeviceID = "DEVICE"
+	driver.clientFactory = func() *metal.APIClient {
+		config := metal.NewConfiguration()
+		config.Servers = metal.ServerConfigurations{{URL: server.URL}}
+		return metal.NewAPIClient(config)
+	}
+
+	got, err := driver.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Running, got)
+}
+
+func TestUserAgentOrdering(t *testing.T) {
+	driver := NewDriver("", "")
+	driver.UserAgentPrefix = "rancher/2.8"
+	driver.UserAgentSuffix = "ci/1.0"
+
+	assert.Equal(t,
+		"rancher/2.8 docker-machine-driver-metal/devel metal-go/0.1 ci/1.0",
+		driver.userAgent("metal-go/0.1"))
+
+	driver.UserAgentPrefix = ""
+	driver.UserAgentSuffix = ""
+	assert.Equal(t, "docker-machine-driver-metal/devel metal-go/0.1", driver.userAgent("metal-go/0.1"))
+}
+
+func TestMergeUserdata(t *testing.T) {
+	merged, err := mergeUserdata("#cloud-config\npackages:\n - curl\n", "#!/bin/sh\necho hello\n")
+	assert.NoError(t, err)
+	assert.Contains(t, merged, "Content-Type: multipart/mixed; boundary=")
+	assert.Contains(t, merged, "text/cloud-config")
+	assert.Contains(t, merged, "text/x-shellscript")
+	assert.Contains(t, merged, "echo hello")
+
+	_, err = mergeUserdata("#cloud-config\n", "this is not cloud-init")
+	assert.ErrorContains(t, err, "not a recognized cloud-init header")
+}
+
+func TestVersion(t *testing.T) {
+	assert.Equal(t, version, Version())
+	assert.NotEmpty(t, Version())
+}
+
+func TestSSHKeyOwnedSurvivesSerialization(t *testing.T) {
+	driver := NewDriver("", "")
+	driver.SSHKeyID = "KEYID"
+	driver.SSHKeyOwned = true
+
+	raw, err := json.Marshal(driver)
+	assert.NoError(t, err)
+
+	restored := NewDriver("", "")
+	assert.NoError(t, json.Unmarshal(raw, restored))
+	assert.True(t, restored.SSHKeyOwned)
+	assert.Equal(t, "KEYID", restored.SSHKeyID)
+}
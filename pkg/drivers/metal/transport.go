@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package metal
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"golang.org/x/time/rate"
+)
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*rate.Limiter{}
+)
+
+// limiterForToken returns the rate limiter shared by every client built for
+// the same auth token, so concurrent driver instances in one process stay
+// under the requests-per-second ceiling together.
+func limiterForToken(token string, rps int) *rate.Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	if l, ok := limiters[token]; ok {
+		return l
+	}
+	l := rate.NewLimiter(rate.Limit(rps), 1)
+	limiters[token] = l
+	return l
+}
+
+// rateLimitRoundTripper delays requests to keep API usage under the
+// configured requests-per-second ceiling, avoiding 429s during batch
+// provisioning.
+type rateLimitRoundTripper struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+func (rt *rateLimitRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := rt.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return rt.base.RoundTrip(req)
+}
+
+// debugRoundTripper logs request metadata and timings for --metal-debug,
+// without the request or response bodies, which may hold credentials or
+// userdata.
+type debugRoundTripper struct {
+	base http.RoundTripper
+}
+
+func (rt *debugRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil {
+		log.Infof("API %s %s failed after %s: %s", req.Method, req.URL.Path, time.Since(start).Round(time.Millisecond), err)
+		return resp, err
+	}
+	log.Infof("API %s %s: %d in %s", req.Method, req.URL.Path, resp.StatusCode, time.Since(start).Round(time.Millisecond))
+	return resp, err
+}
+
+// retryRoundTripper retries transient Equinix Metal API failures.  Idempotent
+// GET requests are retried on connection errors and 5xx responses; rate
+// limited (429) responses are retried for any method because the API rejected
+// the request without acting on it.  Other methods are never blindly retried.
+type retryRoundTripper struct {
+	base       http.RoundTripper
+	maxRetries int
+}
+
+func (rt *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			req.Body = body
+		}
+
+		resp, err = rt.base.RoundTrip(req)
+		if attempt >= rt.maxRetries || !retryable(req, resp, err) {
+			return resp, err
+		}
+
+		// drain the body so the connection can be reused
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		time.Sleep(retryDelay(attempt, resp))
+	}
+}
+
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if req.Method != http.MethodGet {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// retryDelay backs off exponentially, honoring a Retry-After header when the
+// API supplies one.
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			if seconds, err := strconv.Atoi(after); err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return time.Duration(1<<uint(attempt)) * time.Second
+}